@@ -2,13 +2,13 @@ package rex
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
 	"strings"
 	"time"
 
-	"github.com/ije/gox/log"
 	"github.com/ije/gox/utils"
 )
 
@@ -17,10 +17,17 @@ type Handle func(ctx *Context) interface{}
 
 // APIHandler is a query/mutation style API http Handler
 type APIHandler struct {
-	prefix      string
-	middlewares []Handle
-	queries     map[string][]Handle
-	mutations   map[string][]Handle
+	prefix        string
+	middlewares   []Handle
+	queries       map[string][]Handle
+	mutations     map[string][]Handle
+	errorRenderer ErrorRenderer
+	debug         bool
+
+	notFoundHandles         []Handle
+	methodNotAllowedHandles []Handle
+	onPanic                 func(ctx *Context, v interface{}, stack []byte)
+	trustedProxies          *proxyList
 }
 
 // Prefix adds prefix for each api path, like "v2"
@@ -38,6 +45,57 @@ func (a *APIHandler) Use(middlewares ...Handle) {
 	}
 }
 
+// SetErrorRenderer sets the renderer of the error responses, default is the JSONErrorRenderer.
+func (a *APIHandler) SetErrorRenderer(renderer ErrorRenderer) {
+	a.errorRenderer = renderer
+}
+
+// SetDebug sets the debug mode, the messages of the internal errors and the
+// stacks of the panics are sent to the client in the debug mode.
+func (a *APIHandler) SetDebug(debug bool) {
+	a.debug = debug
+}
+
+// SetTrustedProxies sets the CIDRs or IPs of the trusted proxies, the forwarded
+// headers are only used by the `RemoteIP`, `Scheme` and `Host` methods of the
+// Context when the request comes from a trusted proxy. The "unix" entry trusts
+// the peers of the unix domain sockets.
+func (a *APIHandler) SetTrustedProxies(proxies ...string) error {
+	list, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	a.trustedProxies = list
+	return nil
+}
+
+// OnPanic sets the hook that is called with the recovered value and the stack when
+// a handle panics, like reporting to an error tracker. The panics caused by the
+// `Require*` methods are not reported.
+func (a *APIHandler) OnPanic(hook func(ctx *Context, v interface{}, stack []byte)) {
+	a.onPanic = hook
+}
+
+// NotFound sets the handles for the unmatched routes, the default 404 error is
+// replied if no handle replies.
+func (a *APIHandler) NotFound(handles ...Handle) {
+	for _, handle := range handles {
+		if handle != nil {
+			a.notFoundHandles = append(a.notFoundHandles, handle)
+		}
+	}
+}
+
+// MethodNotAllowed sets the handles for the requests whose method is not allowed,
+// the default 405 error is replied if no handle replies.
+func (a *APIHandler) MethodNotAllowed(handles ...Handle) {
+	for _, handle := range handles {
+		if handle != nil {
+			a.methodNotAllowedHandles = append(a.methodNotAllowedHandles, handle)
+		}
+	}
+}
+
 // Query adds a query api
 func (a *APIHandler) Query(endpoint string, handles ...Handle) {
 	endpoint = utils.CleanPath(endpoint)
@@ -66,22 +124,22 @@ func (a *APIHandler) Mutation(endpoint string, handles ...Handle) {
 
 // ServeHTTP implements the http Handler.
 func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.serve(w, r, a.trustedProxies)
+}
+
+// serve handles the request with the trusted proxies, which are resolved by the
+// listener of the server.
+func (a *APIHandler) serve(w http.ResponseWriter, r *http.Request, proxies *proxyList) {
 	startTime := time.Now()
-	wr := &responseWriter{status: 200, rawWriter: w}
-	form := &Form{r}
-	store := &Store{}
-	ctx := &Context{
-		W:           wr,
-		R:           r,
-		Form:        form,
-		Store:       store,
-		sidStore:    defaultSIDStore,
-		sessionPool: defaultSessionPool,
-		logger:      &log.Logger{},
-	}
+	ctx := newContext(w, r)
+	wr, form, store := ctx.W, ctx.Form, ctx.Store
+	ctx.errorRenderer = a.errorRenderer
+	ctx.debug = a.debug
+	ctx.trustedProxies = proxies
+	defer ctx.done()
 
 	defer func() {
-		wr.Close()
+		ctx.writer.Close()
 
 		if ctx.accessLogger != nil && r.Method != "OPTIONS" {
 			ref := r.Referer()
@@ -98,8 +156,8 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				r.ContentLength,
 				ref,
 				strings.ReplaceAll(r.UserAgent(), `"`, `\"`),
-				wr.status,
-				wr.written,
+				ctx.writer.status,
+				ctx.writer.written,
 				time.Since(startTime)/time.Millisecond,
 			)
 		}
@@ -107,11 +165,21 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if v := recover(); v != nil {
+			// the recoverError is used for control flow, not a bug
 			if err, ok := v.(*recoverError); ok {
-				ctx.ejson(&Error{err.status, err.message})
+				e := &Error{Status: err.status, Message: err.message}
+				if err.status >= 500 {
+					e.Cause = errors.New(err.message)
+				}
+				ctx.ejson(e)
 				return
 			}
 
+			// let the http server abort the response
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
 			buf := bytes.NewBuffer(nil)
 			for i := 3; ; i++ {
 				pc, file, line, ok := runtime.Caller(i)
@@ -121,32 +189,45 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprint(buf, "\t", strings.TrimSpace(runtime.FuncForPC(pc).Name()), " ", file, ":", line, "\n")
 			}
 
-			if ctx.logger != nil {
-				ctx.logger.Printf("[panic] %v\n%s", v, buf.String())
+			logf(ctx.logger, levelError, "[panic] %v\n%s", v, buf.String())
+			if a.onPanic != nil {
+				a.onPanic(ctx, v, buf.Bytes())
+			}
+			if ctx.debug {
+				ctx.ejson(&Error{
+					Status:  500,
+					Message: fmt.Sprintf("panic: %v", v),
+					Details: map[string]string{"stack": buf.String()},
+				})
+				return
 			}
-			ctx.ejson(&Error{500, http.StatusText(500)})
+			ctx.ejson(&Error{Status: 500, Message: http.StatusText(500)})
 		}
 	}()
 
-	var apiHandles map[string][]Handle
+	pathname := utils.CleanPath(r.URL.Path)
+	if a.prefix != "/" {
+		pathname = strings.TrimPrefix(pathname, a.prefix)
+	}
+	path := ctx.Path
+	path.raw = pathname
+	path.segments = splitPath(path.segments[:0], pathname[1:])
+
+	var apiHandles, otherHandles map[string][]Handle
+	var allow string
+	var unsupported bool
 	switch r.Method {
 	case "GET":
-		apiHandles = a.queries
+		apiHandles, otherHandles, allow = a.queries, a.mutations, "POST"
 	case "POST":
-		apiHandles = a.mutations
+		apiHandles, otherHandles, allow = a.mutations, a.queries, "GET"
 	default:
-		ctx.ejson(&Error{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
-		return
+		unsupported = true
 	}
 
-	pathname := utils.CleanPath(r.URL.Path)
-	if a.prefix != "/" {
-		pathname = strings.TrimPrefix(pathname, a.prefix)
-	}
-	path := &Path{
-		raw:      pathname,
-		segments: strings.Split(pathname[1:], "/"),
-	}
+	// match the route before the middlewares so that they can key on it
+	route, handles, ok := matchRoute(apiHandles, pathname)
+	ctx.route = route
 
 	for _, handle := range a.middlewares {
 		ctx.W, ctx.R, ctx.Path, ctx.Form, ctx.Store = wr, r, path, form, store
@@ -155,24 +236,27 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			ctx.end(v)
 			return
 		}
+		r = ctx.withContext(r)
 	}
 
-	var handles []Handle
-	var ok bool
-	if len(path.segments) > 0 {
-		handles, ok = apiHandles[pathname]
-	}
 	if !ok {
-		for p, a := range apiHandles {
-			if strings.HasSuffix(p, "/*") && strings.HasPrefix(pathname, p[:len(p)-1]) {
-				handles = a
-				ok = true
-				break
+		if unsupported {
+			var methods []string
+			if _, _, ok := matchRoute(a.queries, pathname); ok {
+				methods = append(methods, "GET")
+			}
+			if _, _, ok := matchRoute(a.mutations, pathname); ok {
+				methods = append(methods, "POST")
 			}
+			allow = strings.Join(methods, ", ")
+		} else if _, _, ok := matchRoute(otherHandles, pathname); !ok {
+			allow = ""
+		}
+		if allow != "" {
+			a.methodNotAllowed(ctx, allow)
+		} else {
+			a.notFound(ctx)
 		}
-	}
-	if !ok {
-		ctx.ejson(&Error{404, "not found"})
 		return
 	}
 
@@ -188,7 +272,7 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			if !isGranted {
-				ctx.ejson(&Error{http.StatusForbidden, http.StatusText(http.StatusForbidden)})
+				ctx.ejson(&Error{Status: http.StatusForbidden, Message: http.StatusText(http.StatusForbidden)})
 				return
 			}
 		}
@@ -199,5 +283,51 @@ func (a *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			ctx.end(v)
 			return
 		}
+		r = ctx.withContext(r)
+	}
+}
+
+func (a *APIHandler) notFound(ctx *Context) {
+	if runHandles(ctx, a.notFoundHandles) {
+		return
+	}
+	ctx.ejson(&Error{Status: 404, Message: "not found"})
+}
+
+func (a *APIHandler) methodNotAllowed(ctx *Context, allow string) {
+	ctx.SetHeader("Allow", allow)
+	if runHandles(ctx, a.methodNotAllowedHandles) {
+		return
+	}
+	ctx.ejson(&Error{Status: http.StatusMethodNotAllowed, Message: http.StatusText(http.StatusMethodNotAllowed)})
+}
+
+// runHandles runs the handles until one returns a value, it returns true
+// if the response is replied.
+func runHandles(ctx *Context, handles []Handle) bool {
+	wr, r, path, form, store := ctx.W, ctx.R, ctx.Path, ctx.Form, ctx.Store
+	for _, handle := range handles {
+		v := handle(ctx)
+		if v != nil {
+			ctx.end(v)
+			return true
+		}
+		r = ctx.withContext(r)
+		ctx.W, ctx.R, ctx.Path, ctx.Form, ctx.Store = wr, r, path, form, store
+	}
+	w, ok := ctx.W.(*responseWriter)
+	return ok && w.headerSent
+}
+
+// matchRoute returns the route pattern and the handles matched by the pathname.
+func matchRoute(apiHandles map[string][]Handle, pathname string) (string, []Handle, bool) {
+	if handles, ok := apiHandles[pathname]; ok {
+		return pathname, handles, true
+	}
+	for p, handles := range apiHandles {
+		if strings.HasSuffix(p, "/*") && strings.HasPrefix(pathname, p[:len(p)-1]) {
+			return p, handles, true
+		}
 	}
+	return "", nil, false
 }
@@ -0,0 +1,97 @@
+package rex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A discardWriter is a http.ResponseWriter that drops the response, it's reused
+// by the benchmarks to count the allocations of rex only.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(status int)      {}
+
+func (w *discardWriter) reset() {
+	for key := range w.header {
+		delete(w.header, key)
+	}
+}
+
+func benchmarkServeHTTP(b *testing.B, api *APIHandler, r *http.Request) {
+	w := &discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.reset()
+		api.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkServeHTTPQuery(b *testing.B) {
+	api := &APIHandler{}
+	api.Query("post/*", func(ctx *Context) interface{} {
+		return ctx.Path.String()
+	})
+	benchmarkServeHTTP(b, api, httptest.NewRequest("GET", "/post/hello-world", nil))
+}
+
+func BenchmarkServeHTTPJSON(b *testing.B) {
+	api := &APIHandler{}
+	api.Query("post/*", func(ctx *Context) interface{} {
+		return map[string]interface{}{"id": 1, "title": "Hello World", "tags": []string{"a", "b"}}
+	})
+	benchmarkServeHTTP(b, api, httptest.NewRequest("GET", "/post/hello-world", nil))
+}
+
+func BenchmarkServeHTTPCompressed(b *testing.B) {
+	body := strings.Repeat("hello world! ", 1024)
+	api := &APIHandler{}
+	api.Use(AutoCompress())
+	api.Query("*", func(ctx *Context) interface{} {
+		return body
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	benchmarkServeHTTP(b, api, r)
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	api := &APIHandler{}
+	api.Use(Decompress(16))
+	api.Mutation("*", func(ctx *Context) interface{} {
+		data, err := io.ReadAll(ctx.R.Body)
+		if err != nil {
+			return fmt.Errorf("read body: %w", err)
+		}
+		return data
+	})
+	for _, c := range []struct {
+		body   string
+		status int
+	}{
+		{"hello", 200},
+		{strings.Repeat("hello", 100), 413},
+	} {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write([]byte(c.body))
+		zw.Close()
+		r := httptest.NewRequest("POST", "/", buf)
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("POST %d bytes: got %d, want %d", len(c.body), w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package rex
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ije/gox/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig contains options for the compression.
+type CompressionConfig struct {
+	// Encodings lists the enabled encodings("zstd", "br" and "gzip") in the order
+	// of server preference, default is ["br", "gzip"].
+	Encodings []string
+	// BrotliLevel is the brotli compression level, default is brotli.BestSpeed.
+	BrotliLevel int
+	// GzipLevel is the gzip compression level, default is gzip.BestSpeed.
+	GzipLevel int
+	// ZstdLevel is the zstd compression level(1-22), default is 1.
+	ZstdLevel int
+	// MinSize is the minimum size of the content to compress, default is 1024.
+	// The content with unknown size(io.Reader) is always compressed.
+	MinSize int
+	// MimeTypes lists the compressable content types, the type ends with "/"
+	// matches all the sub types, like "text/". Default are the text types.
+	MimeTypes []string
+}
+
+var defaultCompressionConfig = &CompressionConfig{}
+
+var defaultCompressableMimeTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"application/manifest+json",
+	"application/problem+json",
+	"image/svg+xml",
+}
+
+func (c *CompressionConfig) encodings() []string {
+	if len(c.Encodings) > 0 {
+		return c.Encodings
+	}
+	return []string{"br", "gzip"}
+}
+
+func (c *CompressionConfig) minSize() int64 {
+	if c.MinSize > 0 {
+		return int64(c.MinSize)
+	}
+	return 1024
+}
+
+// compressable checks whether the content is compressable by the content type
+// and the size, a negative size means unknown.
+func (c *CompressionConfig) compressable(contentType string, size int64) bool {
+	if size >= 0 && size < c.minSize() {
+		return false
+	}
+	if contentType == "" {
+		return false
+	}
+	mimeType, _ := utils.SplitByFirstByte(contentType, ';')
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	mimeTypes := c.MimeTypes
+	if len(mimeTypes) == 0 {
+		mimeTypes = defaultCompressableMimeTypes
+	}
+	for _, t := range mimeTypes {
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(mimeType, t) {
+				return true
+			}
+		} else if mimeType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressableFile checks whether the file is compressable by the name.
+func (c *CompressionConfig) compressableFile(name string, size int64) bool {
+	if len(c.MimeTypes) == 0 && isCompressable(name) {
+		return size < 0 || size >= c.minSize()
+	}
+	return c.compressable(mime.TypeByExtension(path.Ext(name)), size)
+}
+
+// level returns the compression level of the encoding.
+func (c *CompressionConfig) level(encoding string) int {
+	switch encoding {
+	case "br":
+		if c.BrotliLevel > 0 {
+			return c.BrotliLevel
+		}
+		return brotli.BestSpeed
+	case "gzip":
+		if c.GzipLevel > 0 {
+			return c.GzipLevel
+		}
+		return gzip.BestSpeed
+	case "zstd":
+		if c.ZstdLevel > 0 {
+			return c.ZstdLevel
+		}
+		return 1
+	}
+	return 0
+}
+
+func (c *CompressionConfig) newWriter(w io.Writer, encoding string) io.WriteCloser {
+	return newCompressor(w, encoding, c.level(encoding))
+}
+
+func newCompressor(w io.Writer, encoding string, level int) io.WriteCloser {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, level)
+	case "gzip":
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			gw = gzip.NewWriter(w)
+		}
+		return gw
+	case "zstd":
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		return zw
+	}
+	return nil
+}
+
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressorPools sync.Map // "encoding:level" -> *sync.Pool
+
+// acquireCompressor returns a compressor of the encoding and the level from the pool.
+func acquireCompressor(w io.Writer, encoding string, level int) io.WriteCloser {
+	if v, ok := compressorPools.Load(compressorKey(encoding, level)); ok {
+		if cw, ok := v.(*sync.Pool).Get().(compressor); ok {
+			cw.Reset(w)
+			return cw
+		}
+	}
+	return newCompressor(w, encoding, level)
+}
+
+// releaseCompressor puts the closed compressor back to the pool.
+func releaseCompressor(cw io.WriteCloser, encoding string, level int) {
+	c, ok := cw.(compressor)
+	if !ok {
+		return
+	}
+	c.Reset(nil)
+	v, _ := compressorPools.LoadOrStore(compressorKey(encoding, level), &sync.Pool{})
+	v.(*sync.Pool).Put(c)
+}
+
+func compressorKey(encoding string, level int) string {
+	return encoding + ":" + strconv.Itoa(level)
+}
+
+// parseAcceptEncoding returns the acceptable encodings of the Accept-Encoding header
+// from the provided encodings, ordered by the quality values and then the server preference.
+func parseAcceptEncoding(header string, encodings []string) []string {
+	qvalues := parseQValues(header)
+
+	type acceptable struct {
+		name string
+		q    float64
+	}
+	var list []acceptable
+	for _, name := range encodings {
+		q, ok := qvalues[name]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > 0 {
+			list = append(list, acceptable{name, q})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].q > list[j].q
+	})
+
+	ret := make([]string, len(list))
+	for i, a := range list {
+		ret[i] = a.name
+	}
+	return ret
+}
+
+// parseQValues parses the quality values of the Accept-* header.
+func parseQValues(header string) map[string]float64 {
+	qvalues := map[string]float64{}
+	for _, p := range strings.Split(header, ",") {
+		name, params := utils.SplitByFirstByte(p, ';')
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value := utils.SplitByFirstByte(param, '=')
+			if strings.TrimSpace(key) == "q" {
+				v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		qvalues[name] = q
+	}
+	return qvalues
+}
@@ -0,0 +1,352 @@
+package rex
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig loads the ServerConfig from the config file and the `REX_*` environment
+// variables, then validates it. The file format is decided by the extension: ".json",
+// ".yaml"(".yml") or ".toml", no file is loaded if the filename is empty. The environment
+// variables are named by the JSON keys, like `REX_PORT`, `REX_TLS_CERT_FILE` and
+// `REX_TLS_AUTOTLS_HOSTS`, the lists are comma-separated.
+//
+// The server served with the loaded config reloads the `readTimeout`, `writeTimeout`,
+// `cors` and `logLevel` settings on SIGHUP, other settings require a restart.
+func LoadConfig(filename string) (*ServerConfig, error) {
+	config := &ServerConfig{}
+	if filename != "" {
+		if err := config.loadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := setEnvValues(reflect.ValueOf(config).Elem(), "REX"); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.filename = filename
+	config.loaded = true
+	return config, nil
+}
+
+// loadFile decodes the config file, the YAML and TOML documents are converted to
+// JSON to use the JSON keys of the ServerConfig.
+func (config *ServerConfig) loadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+	case ".yaml", ".yml", ".toml":
+		var m map[string]interface{}
+		if ext == ".toml" {
+			err = toml.Unmarshal(data, &m)
+		} else {
+			err = yaml.Unmarshal(data, &m)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		data, err = json.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format '%s'", filename, ext)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// setEnvValues sets the struct fields by the environment variables, the fields
+// without JSON keys and the unsupported types(like []CertKeyPair) are skipped.
+func setEnvValues(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+		fv := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := setEnvValues(fv, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			// allocate the struct only if any of its fields is set
+			pv := reflect.New(field.Type.Elem())
+			if !fv.IsNil() {
+				pv.Elem().Set(fv.Elem())
+			}
+			if err := setEnvValues(pv.Elem(), name); err != nil {
+				return err
+			}
+			if !fv.IsNil() || !pv.Elem().IsZero() {
+				fv.Set(pv)
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool '%s'", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", value)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", value)
+		}
+		v.SetUint(u)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// envName converts the JSON key to the environment variable name,
+// like "readHeaderTimeout" => "READ_HEADER_TIMEOUT", "acceptTOS" => "ACCEPT_TOS".
+func envName(key string) string {
+	runes := []rune(key)
+	buf := make([]rune, 0, len(runes)+4)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if !unicode.IsUpper(prev) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				buf = append(buf, '_')
+			}
+		}
+		buf = append(buf, unicode.ToUpper(r))
+	}
+	return string(buf)
+}
+
+// Validate checks the config values: the ports, the existence of the cert files,
+// the AutoTLS cache dir and the TLS/proxy/log options.
+func (config *ServerConfig) Validate() error {
+	if config.Port > 0 && config.Port == config.TLS.Port && config.Socket == "" {
+		return fmt.Errorf("port: the HTTP and HTTPS servers can't listen on the same port %d", config.Port)
+	}
+	if config.SocketMode > 0777 {
+		return fmt.Errorf("socketMode: invalid file mode %o", config.SocketMode)
+	}
+	if _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		return fmt.Errorf("trustedProxies: %v", err)
+	}
+	if sources, err := parseTrustedProxies(config.ProxyProtocol.TrustedSources); err != nil {
+		return fmt.Errorf("proxyProtocol.trustedSources: %v", err)
+	} else if config.ProxyProtocol.Enable && sources.empty() {
+		return errors.New("proxyProtocol.trustedSources: required to enable the PROXY protocol")
+	}
+	if size := config.HTTP2.MaxReadFrameSize; size != 0 && (size < 16<<10 || size > 16<<20) {
+		return fmt.Errorf("http2.maxReadFrameSize: %d is out of range(16KB - 16MB)", size)
+	}
+	if level := config.LogLevel; level != "" {
+		if _, ok := logLevels[strings.ToLower(level)]; !ok {
+			return fmt.Errorf("logLevel: invalid level '%s'", level)
+		}
+	}
+
+	https := config.TLS
+	if (https.CertFile == "") != (https.KeyFile == "") {
+		return errors.New("tls: both the certFile and keyFile are required")
+	}
+	files := [][2]string{
+		{"tls.certFile", https.CertFile},
+		{"tls.keyFile", https.KeyFile},
+		{"tls.clientCA", https.ClientCA},
+	}
+	for i, pair := range https.Certificates {
+		if pair.CertFile == "" || pair.KeyFile == "" {
+			return fmt.Errorf("tls.certificates[%d]: both the certFile and keyFile are required", i)
+		}
+		files = append(files,
+			[2]string{fmt.Sprintf("tls.certificates[%d].certFile", i), pair.CertFile},
+			[2]string{fmt.Sprintf("tls.certificates[%d].keyFile", i), pair.KeyFile},
+		)
+	}
+	for _, file := range files {
+		if key, name := file[0], file[1]; name != "" {
+			if fi, err := os.Stat(name); err != nil || fi.IsDir() {
+				return fmt.Errorf("%s: file '%s' not found", key, name)
+			}
+		}
+	}
+	if cacheDir := https.AutoTLS.CacheDir; cacheDir != "" {
+		if fi, err := os.Stat(cacheDir); err == nil && !fi.IsDir() {
+			return fmt.Errorf("tls.autotls.cacheDir: '%s' is not a directory", cacheDir)
+		}
+	}
+	if v := https.MinVersion; v != "" {
+		if _, ok := tlsVersions[v]; !ok {
+			return fmt.Errorf("tls.minVersion: invalid TLS version '%s'", v)
+		}
+	}
+	if mode := https.ClientAuth; mode != "" {
+		if _, ok := clientAuthModes[mode]; !ok {
+			return fmt.Errorf("tls.clientAuth: invalid client auth mode '%s'", mode)
+		}
+	}
+	addrs := map[string]bool{}
+	for i, c := range append([]ServerConfig{*config}, config.Listeners...) {
+		if i > 0 {
+			if len(c.Listeners) > 0 {
+				return fmt.Errorf("listeners[%d].listeners: the nested listeners are not supported", i-1)
+			}
+			if err := c.Validate(); err != nil {
+				return fmt.Errorf("listeners[%d].%v", i-1, err)
+			}
+		}
+		ports := []uint16{c.TLS.Port}
+		if c.Socket == "" {
+			ports = append(ports, c.Port)
+		}
+		for _, port := range ports {
+			if port == 0 {
+				continue
+			}
+			addr := fmt.Sprintf("%s:%d", c.Host, port)
+			if addrs[addr] {
+				return fmt.Errorf("listeners: the address '%s' is used by more than one listener", addr)
+			}
+			addrs[addr] = true
+		}
+	}
+	return nil
+}
+
+// A liveConfig holds the settings that are reloaded without restarting the server.
+type liveConfig struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// deadlines is true if the timeouts are changed since the server started,
+	// the deadlines of the connections are reset for each request then.
+	deadlines bool
+	cors      Handle
+}
+
+func (config *ServerConfig) liveConfig(initial *ServerConfig) *liveConfig {
+	live := &liveConfig{
+		readTimeout:  time.Duration(config.ReadTimeout) * time.Second,
+		writeTimeout: time.Duration(config.WriteTimeout) * time.Second,
+		deadlines:    config.ReadTimeout != initial.ReadTimeout || config.WriteTimeout != initial.WriteTimeout,
+	}
+	if config.CORS != nil {
+		live.cors = Cors(*config.CORS)
+	}
+	return live
+}
+
+// watchReload reloads the config file and the environment variables on SIGHUP,
+// the old settings are kept if the new config is invalid. The lives are the live
+// configs of the server and its `Listeners` in order.
+func (config *ServerConfig) watchReload(lives []*atomic.Value) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			newConfig, err := LoadConfig(config.filename)
+			if err != nil {
+				logf(defaultLogger, levelError, "[error] reload config: %v", err)
+				continue
+			}
+			lives[0].Store(newConfig.liveConfig(config))
+			if len(newConfig.Listeners) == len(config.Listeners) {
+				for i := range config.Listeners {
+					lives[i+1].Store(newConfig.Listeners[i].liveConfig(&config.Listeners[i]))
+				}
+			}
+			setLogLevel(newConfig.LogLevel)
+			if !config.sameListeners(newConfig) {
+				logf(defaultLogger, levelWarn, "[warn] reload config: the listener settings are changed, restart the server to apply")
+			}
+		}
+	}()
+}
+
+// sameListeners checks whether the settings except the reloadable ones are same.
+func (config *ServerConfig) sameListeners(other *ServerConfig) bool {
+	return reflect.DeepEqual(config.listenerSettings(), other.listenerSettings())
+}
+
+// listenerSettings returns a copy of the config without the reloadable settings
+// and the fields set by the code, which are not in the config file.
+func (config *ServerConfig) listenerSettings() ServerConfig {
+	c := *config
+	c.ReadTimeout = 0
+	c.WriteTimeout = 0
+	c.CORS = nil
+	c.LogLevel = ""
+	c.Handler = nil
+	c.VirtualHosts = nil
+	c.Listener = nil
+	c.TLS.Listener = nil
+	c.TLS.AutoTLS.Cache = nil
+	if c.Listeners != nil {
+		c.Listeners = make([]ServerConfig, len(config.Listeners))
+		for i := range config.Listeners {
+			c.Listeners[i] = config.Listeners[i].listenerSettings()
+		}
+	}
+	return c
+}
@@ -0,0 +1,65 @@
+package rex
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfigReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rex.json")
+	write := func(data string) {
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"port": 8080, "readTimeout": 10, "listeners": [{"port": 8081, "writeTimeout": 10}]}`)
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lives := []*atomic.Value{{}, {}}
+	lives[0].Store(config.liveConfig(config))
+	lives[1].Store(config.Listeners[0].liveConfig(&config.Listeners[0]))
+	config.watchReload(lives)
+
+	write(`{"port": 8080, "readTimeout": 20, "listeners": [{"port": 8081, "writeTimeout": 20}]}`)
+	newConfig, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.sameListeners(newConfig) {
+		t.Fatal("sameListeners: the timeouts of the listeners should be ignored")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		parent, listener := lives[0].Load().(*liveConfig), lives[1].Load().(*liveConfig)
+		if parent.readTimeout == 20*time.Second && listener.writeTimeout == 20*time.Second {
+			if !parent.deadlines || !listener.deadlines {
+				t.Fatal("the deadlines should be reset after the timeouts are changed")
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("the listeners are not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	newConfig.Listeners[0].Port = 8082
+	if config.sameListeners(newConfig) {
+		t.Fatal("sameListeners: the port change of the listeners should be detected")
+	}
+}
+
+func TestValidateNestedListeners(t *testing.T) {
+	config := &ServerConfig{Listeners: []ServerConfig{{Port: 8081, Listeners: []ServerConfig{{Port: 8082}}}}}
+	if err := config.Validate(); err == nil {
+		t.Fatal("the nested listeners should be rejected")
+	}
+}
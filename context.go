@@ -2,37 +2,122 @@ package rex
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/json"
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/andybalholm/brotli"
 	"github.com/ije/gox/utils"
 	"github.com/ije/rex/session"
 )
 
 // A Context to handle http requests.
 type Context struct {
-	W             http.ResponseWriter
-	R             *http.Request
-	Path          *Path
-	Form          *Form
-	Store         *Store
-	basicAuthUser string
-	acl           map[string]struct{}
-	aclUser       ACLUser
-	session       *Session
-	sessionPool   session.Pool
-	sidStore      session.SIDStore
-	autoCompress  bool
-	logger        Logger
-	accessLogger  Logger
+	W              http.ResponseWriter
+	R              *http.Request
+	Path           *Path
+	Form           *Form
+	Store          *Store
+	basicAuthUser  string
+	acl            map[string]struct{}
+	aclUser        ACLUser
+	session        *Session
+	sessionPool    session.Pool
+	sidStore       session.SIDStore
+	compression    *CompressionConfig
+	jsonConfig     *JSONConfig
+	errorRenderer  ErrorRenderer
+	debug          bool
+	route          string
+	trustedProxies *proxyList
+	logger         Logger
+	accessLogger   Logger
+	writer         responseWriter
+	form           Form
+	path           Path
+	store          Store
+	reqContext     context.Context
+	cancel         context.CancelFunc
+}
+
+// newContext returns a Context of the request. The Context is not pooled since
+// it's a context.Context that may be held by the goroutines after the request is
+// handled, the buffers and the compressors are pooled instead.
+func newContext(w http.ResponseWriter, r *http.Request) *Context {
+	ctx := &Context{
+		R:           r,
+		reqContext:  r.Context(),
+		sidStore:    defaultSIDStore,
+		sessionPool: defaultSessionPool,
+		logger:      defaultLogger,
+	}
+	ctx.writer = responseWriter{status: 200, rawWriter: w}
+	ctx.form = Form{r}
+	ctx.W = &ctx.writer
+	ctx.Path = &ctx.path
+	ctx.Form = &ctx.form
+	ctx.Store = &ctx.store
+	return ctx
+}
+
+// done cancels the context set by the `Timeout` middleware.
+func (ctx *Context) done() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
+// Route returns the matched route pattern, like "/post/*", it's empty if no
+// route is matched.
+func (ctx *Context) Route() string {
+	return ctx.route
+}
+
+// Deadline implements the context.Context, it returns the deadline of the request
+// set by the `Timeout` middleware.
+func (ctx *Context) Deadline() (time.Time, bool) {
+	return ctx.reqContext.Deadline()
+}
+
+// Done implements the context.Context, the channel is closed when the client
+// goes away, the request times out or the request is handled.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.reqContext.Done()
+}
+
+// Err implements the context.Context.
+func (ctx *Context) Err() error {
+	return ctx.reqContext.Err()
+}
+
+// Value implements the context.Context, the string keys are looked up in the
+// Store first, then in the request context.
+func (ctx *Context) Value(key interface{}) interface{} {
+	if k, ok := key.(string); ok {
+		if v, ok := ctx.store.Get(k); ok {
+			return v
+		}
+	}
+	return ctx.reqContext.Value(key)
+}
+
+// withContext returns the request replaced by the `Timeout` middleware, the request
+// is restored before each handle. The Form is kept in sync with the request.
+func (ctx *Context) withContext(r *http.Request) *http.Request {
+	if ctx.reqContext != r.Context() {
+		if ctx.R != nil && ctx.R.Context() == ctx.reqContext {
+			r = ctx.R
+		} else {
+			r = r.WithContext(ctx.reqContext)
+		}
+		ctx.form.R = r
+	}
+	return r
 }
 
 // BasicAuthUser returns the BasicAuth username
@@ -50,6 +135,14 @@ func (ctx *Context) SetACLUser(user ACLUser) {
 	ctx.aclUser = user
 }
 
+// ClientCert returns the verified client certificate of the mutual TLS, or nil.
+func (ctx *Context) ClientCert() *x509.Certificate {
+	if ctx.R.TLS != nil && len(ctx.R.TLS.VerifiedChains) > 0 && len(ctx.R.TLS.VerifiedChains[0]) > 0 {
+		return ctx.R.TLS.VerifiedChains[0][0]
+	}
+	return nil
+}
+
 // Session returns the session if it is undefined then create a new one.
 func (ctx *Context) Session() *Session {
 	if ctx.sessionPool == nil {
@@ -119,62 +212,66 @@ func (ctx *Context) DeleteHeader(key string) {
 	ctx.W.Header().Del(key)
 }
 
-// RemoteIP returns the remote client IP.
-func (ctx *Context) RemoteIP() string {
-	ip := ctx.R.Header.Get("X-Real-IP")
-	if ip == "" {
-		ip = ctx.R.Header.Get("X-Forwarded-For")
-		if ip != "" {
-			ip, _ = utils.SplitByFirstByte(ip, ',')
-		} else {
-			ip = ctx.R.RemoteAddr
-		}
-	}
-	ip, _ = utils.SplitByLastByte(ip, ':')
-	return ip
-}
-
 // EnableCompression enables the compression method based on the Accept-Encoding header
 func (ctx *Context) EnableCompression() {
 	var encoding string
-	for _, p := range strings.Split(ctx.R.Header.Get("Accept-Encoding"), ",") {
-		name, _ := utils.SplitByFirstByte(p, ';')
-		switch strings.ToLower(strings.TrimSpace(name)) {
-		case "br":
-			encoding = "br"
-		case "gzip":
-			if encoding == "" {
-				encoding = "gzip"
-			}
-		}
+	if encodings := ctx.acceptEncodings(); len(encodings) > 0 {
+		encoding = encodings[0]
 	}
 	if encoding != "" {
 		w, ok := ctx.W.(*responseWriter)
 		if ok && !w.headerSent {
-			h := w.Header()
-			if h.Get("Vary") == "" {
-				h.Set("Vary", "Accept-Encoding")
+			config := ctx.compression
+			if config == nil {
+				config = defaultCompressionConfig
+			}
+			level := config.level(encoding)
+			compression := acquireCompressor(w.rawWriter, encoding, level)
+			if compression == nil {
+				return
 			}
+			h := w.Header()
+			addVary(h, "Accept-Encoding")
 			if h.Get("Content-Length") != "" {
 				h.Del("Content-Length")
 			}
 			h.Set("Content-Encoding", encoding)
-			switch encoding {
-			case "br":
-				w.compression = brotli.NewWriterLevel(w.rawWriter, brotli.BestSpeed)
-			case "gzip":
-				w.compression, _ = gzip.NewWriterLevel(w.rawWriter, gzip.BestSpeed)
-			}
+			w.compression = compression
+			w.encoding = encoding
+			w.level = level
 		}
 	}
 }
 
+// acceptEncodings returns the enabled encodings accepted by the Accept-Encoding header
+// in the order of preference.
+func (ctx *Context) acceptEncodings() []string {
+	config := ctx.compression
+	if config == nil {
+		config = defaultCompressionConfig
+	}
+	return parseAcceptEncoding(ctx.R.Header.Get("Accept-Encoding"), config.encodings())
+}
+
+// autoCompress enables the compression if the content is compressable
+// by the Content-Type header and the size, a negative size means unknown.
+func (ctx *Context) autoCompress(size int64) {
+	if ctx.compression != nil && ctx.compression.compressable(ctx.W.Header().Get("Content-Type"), size) {
+		ctx.EnableCompression()
+	}
+}
+
 func (ctx *Context) end(v interface{}, args ...int) {
 	status := 0
 	if len(args) > 0 {
 		status = args[0]
 	}
 
+	// drop the late response of the timed out request
+	if ctx.cancel != nil && !ctx.writer.headerSent && errors.Is(ctx.reqContext.Err(), context.DeadlineExceeded) {
+		v = ctx.reqContext.Err()
+	}
+
 	switch r := v.(type) {
 	case *redirect:
 		http.Redirect(ctx.W, ctx.R, r.url, r.status)
@@ -183,11 +280,7 @@ func (ctx *Context) end(v interface{}, args ...int) {
 		if ctx.W.Header().Get("Content-Type") == "" {
 			ctx.SetHeader("Content-Type", "text/plain; charset=utf-8")
 		}
-		if ctx.autoCompress {
-			if len(r) > 1024 {
-				ctx.EnableCompression()
-			}
-		}
+		ctx.autoCompress(int64(len(r)))
 		if status >= 100 {
 			ctx.W.WriteHeader(status)
 		}
@@ -197,6 +290,7 @@ func (ctx *Context) end(v interface{}, args ...int) {
 		if ctx.W.Header().Get("Content-Type") == "" {
 			ctx.SetHeader("Content-Type", "application/octet-stream")
 		}
+		ctx.autoCompress(int64(len(r)))
 		if status >= 100 {
 			ctx.W.WriteHeader(status)
 		}
@@ -206,34 +300,41 @@ func (ctx *Context) end(v interface{}, args ...int) {
 		if ctx.W.Header().Get("Content-Type") == "" {
 			ctx.SetHeader("Content-Type", "application/octet-stream")
 		}
+		size := int64(-1)
+		if l, ok := r.(interface{ Len() int }); ok {
+			size = int64(l.Len())
+		}
+		ctx.autoCompress(size)
 		if status >= 100 {
 			ctx.W.WriteHeader(status)
 		}
 		io.Copy(ctx.W, r)
 
 	case *contentful:
-		if ctx.autoCompress {
-			compressable := false
-			switch strings.TrimPrefix(path.Ext(r.name), ".") {
-			case "html", "htm", "xml", "svg", "css", "less", "sass", "scss", "json", "json5", "map", "js", "jsx", "mjs", "cjs", "ts", "tsx", "md", "mdx", "yaml", "txt", "wasm":
-				compressable = true
+		if r.encoding != "" {
+			h := ctx.W.Header()
+			addVary(h, "Accept-Encoding")
+			h.Set("Content-Encoding", r.encoding)
+		} else if ctx.compression != nil {
+			size, err := r.content.Seek(0, io.SeekEnd)
+			if err != nil {
+				ctx.ejson(internalError(err))
+				return
+			}
+			_, err = r.content.Seek(0, io.SeekStart)
+			if err != nil {
+				ctx.ejson(internalError(err))
+				return
 			}
-			if compressable {
-				size, err := r.content.Seek(0, io.SeekEnd)
-				if err != nil {
-					ctx.ejson(&Error{500, err.Error()})
-					return
-				}
-				_, err = r.content.Seek(0, io.SeekStart)
-				if err != nil {
-					ctx.ejson(&Error{500, err.Error()})
-					return
-				}
-				if size > 1024 {
-					ctx.EnableCompression()
-				}
+			if ctx.compression.compressableFile(r.name, size) {
+				ctx.EnableCompression()
 			}
 		}
+		h := ctx.W.Header()
+		if etag, encoding := h.Get("ETag"), h.Get("Content-Encoding"); encoding != "" && strings.HasSuffix(etag, `"`) {
+			// the encoded representation must have a different strong etag
+			h.Set("ETag", etag[:len(etag)-1]+"-"+encoding+`"`)
+		}
 		http.ServeContent(ctx.W, ctx.R, r.name, r.mtime, r.content)
 		c, ok := r.content.(io.Closer)
 		if ok {
@@ -248,32 +349,36 @@ func (ctx *Context) end(v interface{}, args ...int) {
 		}
 
 	case *fs:
-		filepath := path.Join(r.root, ctx.Path.String())
-		fi, err := os.Stat(filepath)
-		if err == nil && fi.IsDir() {
-			filepath = path.Join(filepath, "index.html")
-			_, err = os.Stat(filepath)
+		ctx.serveFS(r)
+
+	case error:
+		if errors.Is(r, context.DeadlineExceeded) {
+			ctx.ejson(&Error{Status: http.StatusServiceUnavailable, Message: "timeout", Cause: r})
+			return
 		}
-		if err != nil && os.IsNotExist(err) && r.fallback != "" {
-			filepath = path.Join(r.root, utils.CleanPath(r.fallback))
-			_, err = os.Stat(filepath)
+		if errors.Is(r, context.Canceled) && ctx.reqContext.Err() != nil {
+			// the client went away
+			return
 		}
-		if err != nil {
-			if os.IsNotExist(err) {
-				ctx.ejson(&Error{404, "not found"})
-			} else {
-				ctx.ejson(&Error{500, err.Error()})
+		var tooLarge *http.MaxBytesError
+		if errors.As(r, &tooLarge) {
+			ctx.ejson(&Error{Status: http.StatusRequestEntityTooLarge, Message: "request body too large", Cause: r})
+			return
+		}
+		var e *Error
+		if errors.As(r, &e) {
+			if status >= 100 && status != e.Status {
+				copy := *e
+				copy.Status = status
+				e = &copy
 			}
+			ctx.ejson(e)
 			return
 		}
-		ctx.end(File(filepath))
-
-	case error:
-		if status >= 100 {
-			ctx.ejson(&Error{status, r.Error()})
-		} else {
-			ctx.ejson(&Error{500, r.Error()})
+		if status < 100 {
+			status = 500
 		}
+		ctx.ejson(&Error{Status: status, Message: r.Error(), Cause: r})
 
 	default:
 		_, err := utils.ToNumber(r)
@@ -286,11 +391,7 @@ func (ctx *Context) end(v interface{}, args ...int) {
 			return
 		}
 
-		switch e := r.(type) {
-		case *Error:
-			ctx.ejson(e)
-			return
-		case Error:
+		if e, ok := r.(Error); ok {
 			ctx.ejson(&e)
 			return
 		}
@@ -300,30 +401,69 @@ func (ctx *Context) end(v interface{}, args ...int) {
 }
 
 func (ctx *Context) ejson(err *Error) {
-	if err.Status >= 500 && ctx.logger != nil {
-		ctx.logger.Printf("[error] %s", err.Message)
+	if err.Status >= 500 {
+		logf(ctx.logger, levelError, "[error] %s", err.Error())
+		// don't leak the internal error messages to the client
+		if err.Cause != nil && err.Message == err.Cause.Error() && !ctx.debug {
+			err = &Error{Status: err.Status, Message: http.StatusText(err.Status), Code: err.Code}
+		}
+	}
+	render := ctx.errorRenderer
+	if render == nil {
+		render = JSONErrorRenderer
+	}
+	render(ctx, err)
+}
+
+// addVary adds the header name to the Vary header unless it's listed already.
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.EqualFold(v, name) {
+				return
+			}
+		}
 	}
-	ctx.json(map[string]interface{}{
-		"error": err,
-	}, err.Status)
+	h.Add("Vary", name)
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(nil)
+	},
 }
 
 func (ctx *Context) json(v interface{}, status int) {
-	buf := bytes.NewBuffer(nil)
-	err := json.NewEncoder(buf).Encode(v)
-	ctx.SetHeader("Content-Type", "application/json; charset=utf-8")
+	ctx.jsonWithType(v, status, "application/json; charset=utf-8")
+}
+
+func (ctx *Context) jsonWithType(v interface{}, status int, contentType string) {
+	config := ctx.jsonConfig
+	if config == nil {
+		config = defaultJSONConfig
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		// don't keep the large buffers in the pool
+		if buf.Cap() <= 64<<10 {
+			buf.Reset()
+			bufferPool.Put(buf)
+		}
+	}()
+	ctx.SetHeader("Content-Type", contentType)
+	w := &jsonWriter{ctx: ctx, status: status, buf: buf, threshold: config.threshold()}
+	err := config.encode(w, v)
 	if err != nil {
+		if w.committed {
+			// the response is partially sent, nothing can be replied
+			logf(ctx.logger, levelError, "[error] json: %v", err)
+			return
+		}
 		ctx.W.WriteHeader(500)
 		ctx.W.Write([]byte(`{"error": {"status": 500, "message": "bad json"}}`))
 		return
 	}
-	if ctx.autoCompress {
-		if buf.Len() > 1024 {
-			ctx.EnableCompression()
-		}
-	}
-	if status >= 100 {
-		ctx.W.WriteHeader(status)
+	if !w.committed {
+		w.commit(int64(buf.Len()))
 	}
-	io.Copy(ctx.W, buf)
 }
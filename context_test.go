@@ -0,0 +1,59 @@
+package rex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextAfterHandled(t *testing.T) {
+	const n = 200
+	type result struct {
+		want string
+		got  interface{}
+	}
+	results := make(chan result, n)
+	api := &APIHandler{}
+	api.Query("*", func(ctx *Context) interface{} {
+		id := ctx.Form.Value("id")
+		ctx.Store.Set("id", id)
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			results <- result{id, ctx.Value("id")}
+		}()
+		return id
+	})
+	for i := 0; i < n; i++ {
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?id="+strconv.Itoa(i), nil))
+	}
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.got != r.want {
+			t.Fatalf("ctx.Value(\"id\") = %v after the request is handled, want %s", r.got, r.want)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	for _, c := range []struct {
+		vary []string
+		want []string
+	}{
+		{nil, []string{"Accept-Encoding"}},
+		{[]string{"Origin"}, []string{"Origin", "Accept-Encoding"}},
+		{[]string{"Origin, accept-encoding"}, []string{"Origin, accept-encoding"}},
+		{[]string{"*"}, []string{"*"}},
+	} {
+		h := http.Header{}
+		for _, v := range c.vary {
+			h.Add("Vary", v)
+		}
+		addVary(h, "Accept-Encoding")
+		if got := strings.Join(h.Values("Vary"), "|"); got != strings.Join(c.want, "|") {
+			t.Errorf("addVary(%q): got %q, want %q", c.vary, h.Values("Vary"), c.want)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package rex
 import (
 	"time"
 
+	"github.com/ije/gox/log"
 	"github.com/ije/rex/session"
 )
 
 var defaultAPIHanlder = &APIHandler{}
 var defaultSessionPool = session.NewMemorySessionPool(time.Hour / 2)
 var defaultSIDStore = session.NewCookieSIDStore("")
+var defaultLogger = &log.Logger{}
 
 // Default returns the default REST
 func Default() *APIHandler {
@@ -25,6 +27,17 @@ func Use(middlewares ...Handle) {
 	defaultAPIHanlder.Use(middlewares...)
 }
 
+// SetErrorRenderer sets the renderer of the error responses, default is the JSONErrorRenderer.
+func SetErrorRenderer(renderer ErrorRenderer) {
+	defaultAPIHanlder.SetErrorRenderer(renderer)
+}
+
+// SetDebug sets the debug mode, the messages of the internal errors and the
+// stacks of the panics are sent to the client in the debug mode.
+func SetDebug(debug bool) {
+	defaultAPIHanlder.SetDebug(debug)
+}
+
 // Query adds a query api
 func Query(endpoint string, handles ...Handle) {
 	defaultAPIHanlder.Query(endpoint, handles...)
@@ -34,3 +47,23 @@ func Query(endpoint string, handles ...Handle) {
 func Mutation(endpoint string, handles ...Handle) {
 	defaultAPIHanlder.Mutation(endpoint, handles...)
 }
+
+// NotFound sets the handles for the unmatched routes.
+func NotFound(handles ...Handle) {
+	defaultAPIHanlder.NotFound(handles...)
+}
+
+// MethodNotAllowed sets the handles for the requests whose method is not allowed.
+func MethodNotAllowed(handles ...Handle) {
+	defaultAPIHanlder.MethodNotAllowed(handles...)
+}
+
+// OnPanic sets the hook that is called when a handle panics.
+func OnPanic(hook func(ctx *Context, v interface{}, stack []byte)) {
+	defaultAPIHanlder.OnPanic(hook)
+}
+
+// SetTrustedProxies sets the CIDRs or IPs of the trusted proxies.
+func SetTrustedProxies(proxies ...string) error {
+	return defaultAPIHanlder.SetTrustedProxies(proxies...)
+}
@@ -0,0 +1,113 @@
+package rex
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// An ErrorRenderer renders the error response.
+type ErrorRenderer func(ctx *Context, err *Error)
+
+// JSONErrorRenderer renders the error as `{"error": {"status": 404, "message": "not found"}}`,
+// it's the default renderer.
+func JSONErrorRenderer(ctx *Context, err *Error) {
+	ctx.json(map[string]interface{}{
+		"error": err,
+	}, err.Status)
+}
+
+// A Problem is the RFC 7807 problem details object.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// extension members
+	Code    string            `json:"code,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// ProblemJSONErrorRenderer renders the error as the RFC 7807 `application/problem+json`.
+func ProblemJSONErrorRenderer(ctx *Context, err *Error) {
+	problem := &Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(err.Status),
+		Status:   err.Status,
+		Instance: ctx.R.URL.Path,
+		Code:     err.Code,
+		Details:  err.Details,
+	}
+	if err.Message != problem.Title {
+		problem.Detail = err.Message
+	}
+	ctx.jsonWithType(problem, err.Status, "application/problem+json; charset=utf-8")
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}</title>
+<style>body{font-family:sans-serif;text-align:center;padding-top:10vh}p{color:#666}</style>
+</head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+{{if ne .Message .Title}}<p>{{.Message}}</p>{{end}}
+{{range $key, $value := .Details}}<h3>{{$key}}</h3><pre style="text-align:left">{{$value}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// HTMLErrorRenderer returns an ErrorRenderer that renders an error page when the
+// client prefers `text/html`, otherwise the fallback renderer is used. The template
+// is executed with the `Status`, `Title`, `Message` and `Details` fields, a default
+// page is used if the tpl is nil.
+func HTMLErrorRenderer(tpl Tpl, fallback ErrorRenderer) ErrorRenderer {
+	if tpl == nil {
+		tpl = defaultErrorTemplate
+	}
+	if fallback == nil {
+		fallback = JSONErrorRenderer
+	}
+	return func(ctx *Context, err *Error) {
+		if !ctx.prefersHTML() {
+			fallback(ctx, err)
+			return
+		}
+
+		buf := bytes.NewBuffer(nil)
+		e := tpl.Execute(buf, map[string]interface{}{
+			"Status":  err.Status,
+			"Title":   http.StatusText(err.Status),
+			"Message": err.Message,
+			"Details": err.Details,
+		})
+		if e != nil {
+			fallback(ctx, err)
+			return
+		}
+		ctx.SetHeader("Content-Type", "text/html; charset=utf-8")
+		ctx.autoCompress(int64(buf.Len()))
+		ctx.W.WriteHeader(err.Status)
+		ctx.W.Write(buf.Bytes())
+	}
+}
+
+// prefersHTML checks whether the client prefers `text/html` to `application/json`.
+func (ctx *Context) prefersHTML() bool {
+	qvalues := parseQValues(ctx.R.Header.Get("Accept"))
+	html, ok := qvalues["text/html"]
+	if !ok || html <= 0 {
+		return false
+	}
+	json, ok := qvalues["application/json"]
+	if !ok {
+		json, ok = qvalues["application/*"]
+	}
+	if !ok {
+		json = qvalues["*/*"]
+	}
+	return html > json || (html == json && !ok)
+}
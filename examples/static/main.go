@@ -7,8 +7,9 @@ import (
 func main() {
 	rex.Use(rex.AutoCompress())
 
+	www := rex.FS("./www", "e404.html", rex.FSConfig{Precompress: true})
 	rex.Query("*", func(ctx *rex.Context) interface{} {
-		return rex.FS("./www", "e404.html")
+		return www
 	})
 
 	<-rex.Start(8080)
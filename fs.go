@@ -0,0 +1,442 @@
+package rex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ije/gox/utils"
+)
+
+// FSConfig contains options for the FS.
+type FSConfig struct {
+	// Precompress compresses the compressable assets with the best levels at startup
+	// and caches them in memory, the assets without the `.br`/`.gz`/`.zst` siblings
+	// are compressed with the levels of the `AutoCompress` on the first request if
+	// they are added after startup. The cache is shared by the FS instances of the
+	// same root(or fsys), the total size of the cache is limited to 128MB.
+	Precompress bool
+	// Compression sets the Encodings and the MinSize of the assets precompressed at
+	// startup, default are all the encodings("br", "gzip" and "zstd") and 1024 bytes.
+	Compression *CompressionConfig
+	// CacheControl sets the Cache-Control header for the files matched by the rules,
+	// the first matched rule wins.
+	CacheControl []CacheRule
+	// ETag sets the strong ETag header by the content hash of the files.
+	ETag bool
+	// SPA applies the fallback to the navigation requests (Accept: text/html) only,
+	// other requests of missing files get 404.
+	SPA bool
+	// Listing renders the directory listing when the directory has no index.html.
+	Listing ListingConfig
+	// DenyDotfiles denies the files and directories whose name starts with ".",
+	// except the ".well-known" directory.
+	DenyDotfiles bool
+	// DenySymlinkEscape denies the symlinks that point outside of the root,
+	// it only works with the FS rooted at an OS directory.
+	DenySymlinkEscape bool
+	// Allow only allows the files matched by the glob patterns if it's not empty.
+	Allow []string
+	// Deny denies the files matched by the glob patterns.
+	Deny []string
+}
+
+// A CacheRule sets the Cache-Control header for the files matched by the Glob or the Regexp.
+// The Glob is matched against the file name, or the file path if it contains "/".
+type CacheRule struct {
+	Glob   string
+	Regexp *regexp.Regexp
+	Value  string
+}
+
+func (rule *CacheRule) match(name string) bool {
+	if rule.Glob != "" && matchGlob(rule.Glob, name) {
+		return true
+	}
+	return rule.Regexp != nil && rule.Regexp.MatchString("/"+name)
+}
+
+// matchGlob matches the glob pattern against the file name, or the file
+// path if the pattern contains "/".
+func matchGlob(pattern string, name string) bool {
+	s := path.Base(name)
+	if strings.ContainsRune(pattern, '/') {
+		s = "/" + name
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+type fs struct {
+	root     string // the OS directory, empty for FSys
+	fsys     iofs.FS
+	fallback string
+	config   FSConfig
+	cache    *fsCache
+}
+
+// A fsCache holds the compressed assets and the ETags of a file system, it's shared
+// by the FS instances of the same root or fsys.
+type fsCache struct {
+	precompress sync.Once
+	assets      sync.Map // "name:encoding" -> *compressedAsset
+	etags       sync.Map // name -> *fileETag
+}
+
+type fsKey struct {
+	root string
+	fsys iofs.FS
+}
+
+var fsCaches sync.Map // fsKey -> *fsCache
+
+// maxCompressedSize is the limit of the total size of the cached compressed assets.
+const maxCompressedSize = 128 << 20
+
+var (
+	compressedSize atomic.Int64
+	// compressSem limits the concurrent compressions of the FS
+	compressSem = make(chan struct{}, runtime.NumCPU())
+)
+
+// bestCompression is used to precompress the assets at startup.
+var bestCompression = CompressionConfig{
+	BrotliLevel: brotli.BestCompression,
+	GzipLevel:   gzip.BestCompression,
+	ZstdLevel:   19,
+}
+
+type fileETag struct {
+	mtime time.Time
+	size  int64
+	etag  string
+}
+
+type compressedAsset struct {
+	mtime time.Time
+	size  int64
+	data  []byte
+}
+
+// FS replies to the request with the contents of the file system rooted at root,
+// it panics if the root is not a directory.
+func FS(root string, fallback string, config ...FSConfig) interface{} {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		panic(fmt.Errorf("rex.FS: %v", err))
+	}
+	if !fi.IsDir() {
+		panic(fmt.Errorf("rex.FS: root '%s' is not a directory", root))
+	}
+	key := &fsKey{root: root}
+	if abs, err := filepath.Abs(root); err == nil {
+		key.root = abs
+	}
+	return newFS(root, os.DirFS(root), key, fallback, config)
+}
+
+// FSys replies to the request with the contents of the provided file system,
+// like an `embed.FS`. It panics if the fsys is nil.
+func FSys(fsys iofs.FS, fallback string, config ...FSConfig) interface{} {
+	if fsys == nil {
+		panic(errors.New("rex.FSys: nil file system"))
+	}
+	var key *fsKey
+	if reflect.TypeOf(fsys).Comparable() {
+		key = &fsKey{fsys: fsys}
+	}
+	return newFS("", fsys, key, fallback, config)
+}
+
+// newFS creates a fs with the cache of the key, the cache is not shared if the key is nil.
+func newFS(root string, fsys iofs.FS, key *fsKey, fallback string, config []FSConfig) *fs {
+	f := &fs{root: root, fsys: fsys, fallback: fallback, cache: &fsCache{}}
+	if len(config) > 0 {
+		f.config = config[0]
+	}
+	if key != nil {
+		v, _ := fsCaches.LoadOrStore(*key, f.cache)
+		f.cache = v.(*fsCache)
+	}
+	if f.config.Precompress {
+		f.cache.precompress.Do(f.precompress)
+	}
+	return f
+}
+
+// precompress compresses all the compressable files that have no sidecars.
+func (f *fs) precompress() {
+	encodings := []string{"br", "gzip", "zstd"}
+	config := bestCompression
+	if c := f.config.Compression; c != nil {
+		if len(c.Encodings) > 0 {
+			encodings = c.Encodings
+		}
+		config.MinSize = c.MinSize
+	}
+	iofs.WalkDir(f.fsys, ".", func(name string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isCompressable(name) {
+			return nil
+		}
+		for _, encoding := range encodings {
+			if !f.hasSidecar(name, encoding) {
+				f.compressed(name, encoding, &config)
+			}
+		}
+		return nil
+	})
+}
+
+// allowed checks whether the file is allowed to be served by the policies.
+func (f *fs) allowed(name string) bool {
+	if name == "." {
+		return true
+	}
+	if f.config.DenyDotfiles {
+		for _, segment := range strings.Split(name, "/") {
+			if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+				return false
+			}
+		}
+	}
+	if len(f.config.Allow) > 0 {
+		allowed := false
+		for _, pattern := range f.config.Allow {
+			if matchGlob(pattern, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, pattern := range f.config.Deny {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if f.config.DenySymlinkEscape && f.root != "" {
+		root, err := filepath.EvalSymlinks(f.root)
+		if err != nil {
+			return false
+		}
+		real, err := filepath.EvalSymlinks(filepath.Join(f.root, filepath.FromSlash(name)))
+		if err != nil {
+			// let the caller handle the non-existent file
+			return os.IsNotExist(err)
+		}
+		rel, err := filepath.Rel(root, real)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
+
+// stat returns the file info, or a not-exist error if the file is denied by the policies.
+func (f *fs) stat(name string) (iofs.FileInfo, error) {
+	if !f.allowed(name) {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: iofs.ErrNotExist}
+	}
+	return iofs.Stat(f.fsys, name)
+}
+
+func (f *fs) hasSidecar(name string, encoding string) bool {
+	fi, err := f.stat(name + encodingExts[encoding])
+	return err == nil && !fi.IsDir()
+}
+
+// compressed returns the cached compressed content of the file, the file is
+// compressed by the config again if it has been changed. The file smaller than
+// the MinSize of the config is not compressed, nor when the max concurrent
+// compressions are running.
+func (f *fs) compressed(name string, encoding string, config *CompressionConfig) *contentful {
+	fi, err := iofs.Stat(f.fsys, name)
+	if err != nil || fi.IsDir() || fi.Size() < config.minSize() {
+		return nil
+	}
+
+	key := name + ":" + encoding
+	if v, ok := f.cache.assets.Load(key); ok {
+		asset := v.(*compressedAsset)
+		if asset.mtime.Equal(fi.ModTime()) && asset.size == fi.Size() {
+			return &contentful{name: path.Base(name), mtime: asset.mtime, content: bytes.NewReader(asset.data), encoding: encoding}
+		}
+	}
+
+	select {
+	case compressSem <- struct{}{}:
+		defer func() { <-compressSem }()
+	default:
+		return nil
+	}
+
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	buf := bytes.NewBuffer(nil)
+	w := config.newWriter(buf, encoding)
+	if w == nil {
+		return nil
+	}
+	if _, err = io.Copy(w, file); err != nil {
+		return nil
+	}
+	if err = w.Close(); err != nil {
+		return nil
+	}
+
+	asset := &compressedAsset{fi.ModTime(), fi.Size(), buf.Bytes()}
+	f.cache.store(key, asset)
+	return &contentful{name: path.Base(name), mtime: asset.mtime, content: bytes.NewReader(asset.data), encoding: encoding}
+}
+
+// store caches the asset, the stale asset of the key is dropped if the total size
+// of the cached assets would exceed the maxCompressedSize.
+func (c *fsCache) store(key string, asset *compressedAsset) {
+	size := int64(len(asset.data))
+	if compressedSize.Add(size) > maxCompressedSize {
+		compressedSize.Add(-size)
+		if old, loaded := c.assets.LoadAndDelete(key); loaded {
+			compressedSize.Add(-int64(len(old.(*compressedAsset).data)))
+		}
+		return
+	}
+	if old, loaded := c.assets.Swap(key, asset); loaded {
+		compressedSize.Add(-int64(len(old.(*compressedAsset).data)))
+	}
+}
+
+// etag returns the strong ETag of the file by the content hash.
+func (f *fs) etag(name string) string {
+	fi, err := iofs.Stat(f.fsys, name)
+	if err != nil {
+		return ""
+	}
+
+	if v, ok := f.cache.etags.Load(name); ok {
+		e := v.(*fileETag)
+		if e.mtime.Equal(fi.ModTime()) && e.size == fi.Size() {
+			return e.etag
+		}
+	}
+
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return ""
+	}
+
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+	f.cache.etags.Store(name, &fileETag{fi.ModTime(), fi.Size(), etag})
+	return etag
+}
+
+// encodingExts maps the content encodings to the extensions of the precompressed sidecars.
+var encodingExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+func (ctx *Context) serveFS(r *fs) {
+	name := strings.Trim(ctx.Path.String(), "/")
+	if name == "" {
+		name = "."
+	}
+	fi, err := r.stat(name)
+	if err == nil && fi.IsDir() {
+		dir := name
+		name = path.Join(name, "index.html")
+		_, err = r.stat(name)
+		if err != nil && os.IsNotExist(err) && r.config.Listing.Enable {
+			ctx.listDir(r, dir)
+			return
+		}
+	}
+	if err != nil && os.IsNotExist(err) && r.fallback != "" && (!r.config.SPA || ctx.isNavigation()) {
+		name = strings.TrimPrefix(utils.CleanPath(r.fallback), "/")
+		_, err = r.stat(name)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			ctx.ejson(&Error{Status: 404, Message: "not found"})
+		} else {
+			ctx.ejson(internalError(err))
+		}
+		return
+	}
+
+	h := ctx.W.Header()
+	for _, rule := range r.config.CacheControl {
+		if rule.match(name) {
+			h.Set("Cache-Control", rule.Value)
+			break
+		}
+	}
+	if r.config.ETag {
+		if etag := r.etag(name); etag != "" {
+			h.Set("ETag", etag)
+		}
+	}
+
+	if ctx.compression != nil && ctx.compression.compressableFile(name, -1) {
+		for _, encoding := range ctx.acceptEncodings() {
+			if r.hasSidecar(name, encoding) {
+				file := FileFS(r.fsys, name+encodingExts[encoding])
+				file.name = path.Base(name)
+				file.encoding = encoding
+				ctx.end(file)
+				return
+			}
+			if r.config.Precompress {
+				if file := r.compressed(name, encoding, ctx.compression); file != nil {
+					ctx.end(file)
+					return
+				}
+			}
+		}
+	}
+
+	ctx.end(FileFS(r.fsys, name))
+}
+
+// isNavigation checks whether the request is a browser navigation.
+func (ctx *Context) isNavigation() bool {
+	if ctx.R.Header.Get("Sec-Fetch-Mode") == "navigate" {
+		return true
+	}
+	return strings.Contains(ctx.R.Header.Get("Accept"), "text/html")
+}
+
+func isCompressable(name string) bool {
+	switch strings.TrimPrefix(path.Ext(name), ".") {
+	case "html", "htm", "xml", "svg", "css", "less", "sass", "scss", "json", "json5", "map", "js", "jsx", "mjs", "cjs", "ts", "tsx", "md", "mdx", "yaml", "txt", "wasm":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package rex
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFSDirIndex(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "index.html"), []byte("<h1>dir</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api := &APIHandler{}
+	api.Query("*", func(ctx *Context) interface{} {
+		return FS(root, "")
+	})
+	for _, p := range []string{"/dir", "/dir/"} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != 200 || w.Body.String() != "<h1>dir</h1>" {
+			t.Fatalf("GET %s: got %d %q, want 200 %q", p, w.Code, w.Body.String(), "<h1>dir</h1>")
+		}
+	}
+}
+
+func TestFSListing(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a dir", "sub#1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a dir", "sub#1", "x?.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api := &APIHandler{}
+	api.Query("*", func(ctx *Context) interface{} {
+		return FS(root, "", FSConfig{Listing: ListingConfig{Enable: true}})
+	})
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", p, nil)
+		r.Header.Set("Accept", "application/json")
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	var listing Listing
+	w := get("/a%20dir/")
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil || w.Code != 200 {
+		t.Fatalf("GET /a%%20dir/: got %d %s", w.Code, w.Body.String())
+	}
+	if len(listing.Entries) != 1 || listing.Entries[0].Href != "/a%20dir/sub%231/" {
+		t.Fatalf("unexpected entries %+v", listing.Entries)
+	}
+	if listing.Parent != "/" {
+		t.Fatalf("got parent %q, want %q", listing.Parent, "/")
+	}
+
+	w = get(listing.Entries[0].Href)
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil || w.Code != 200 {
+		t.Fatalf("GET %s: got %d %s", listing.Entries[0].Href, w.Code, w.Body.String())
+	}
+	if len(listing.Entries) != 1 || listing.Entries[0].Href != "/a%20dir/sub%231/x%3F.txt" {
+		t.Fatalf("unexpected entries %+v", listing.Entries)
+	}
+	if listing.Parent != "/a%20dir" {
+		t.Fatalf("got parent %q, want %q", listing.Parent, "/a%20dir")
+	}
+	if w = get(listing.Entries[0].Href); w.Code != 200 || w.Body.String() != "x" {
+		t.Fatalf("GET %s: got %d %q", listing.Entries[0].Href, w.Code, w.Body.String())
+	}
+}
+
+func TestFSPrecompressCache(t *testing.T) {
+	root := t.TempDir()
+	js := strings.Repeat("console.log('hello world');\n", 100)
+	if err := os.WriteFile(filepath.Join(root, "app.js"), []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := FSConfig{Precompress: true, Compression: &CompressionConfig{Encodings: []string{"gzip"}}}
+	a := FS(root, "", config).(*fs)
+	b := FS(root+"/", "", config).(*fs)
+	if a.cache != b.cache {
+		t.Fatal("the FS instances of the same root should share the cache")
+	}
+	if _, ok := a.cache.assets.Load("app.js:gzip"); !ok {
+		t.Fatal("app.js is not precompressed")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "new.js"), []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api := &APIHandler{}
+	api.Use(AutoCompress())
+	api.Query("*", func(ctx *Context) interface{} {
+		return FS(root, "", config)
+	})
+	r := httptest.NewRequest("GET", "/new.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("GET /new.js: got %d, Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(zr); string(data) != js {
+		t.Fatal("GET /new.js: the decompressed content is not same")
+	}
+	if _, ok := a.cache.assets.Load("new.js:gzip"); !ok {
+		t.Fatal("new.js is not cached after the request")
+	}
+}
+
+func TestFSAllowed(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, name := range []string{"index.html", "app.js", ".env", ".well-known/security.txt", "private/key.pem", ".git/config"} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "app.js"), filepath.Join(root, "link.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		config FSConfig
+		name   string
+		want   bool
+	}{
+		{FSConfig{}, ".", true},
+		{FSConfig{}, ".env", true},
+		{FSConfig{}, "escape.txt", true},
+		{FSConfig{DenyDotfiles: true}, ".env", false},
+		{FSConfig{DenyDotfiles: true}, ".git/config", false},
+		{FSConfig{DenyDotfiles: true}, ".well-known/security.txt", true},
+		{FSConfig{DenyDotfiles: true}, "app.js", true},
+		{FSConfig{DenySymlinkEscape: true}, "escape.txt", false},
+		{FSConfig{DenySymlinkEscape: true}, "link.js", true},
+		{FSConfig{DenySymlinkEscape: true}, "missing.js", true},
+		{FSConfig{Allow: []string{"*.js", "*.html"}}, "app.js", true},
+		{FSConfig{Allow: []string{"*.js", "*.html"}}, "private/key.pem", false},
+		{FSConfig{Deny: []string{"*.pem"}}, "private/key.pem", false},
+		{FSConfig{Deny: []string{"/private/*"}}, "private/key.pem", false},
+		{FSConfig{Deny: []string{"/private/*"}}, "app.js", true},
+		{FSConfig{Allow: []string{"*.js"}, Deny: []string{"link.js"}}, "link.js", false},
+	} {
+		f := FS(root, "", c.config).(*fs)
+		if got := f.allowed(c.name); got != c.want {
+			t.Errorf("allowed(%q) with %+v: got %v, want %v", c.name, c.config, got, c.want)
+		}
+	}
+}
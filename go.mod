@@ -1,9 +1,15 @@
 module github.com/ije/rex
 
-go 1.16
+go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/andybalholm/brotli v1.0.4
 	github.com/ije/gox v0.6.1
-	golang.org/x/crypto v0.0.0-20220313003712-b769efc7c000
+	github.com/klauspost/compress v1.15.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,81 @@
+package rex
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// JSONConfig contains options for the JSON encoding.
+type JSONConfig struct {
+	// Stream writes the JSON to the (compressed) response writer directly instead
+	// of buffering the whole output, the 500 error can't be replied if the
+	// encoding fails after the first write.
+	Stream bool
+	// StreamThreshold starts streaming once the buffered output exceeds the size,
+	// zero means never unless the Stream is enabled.
+	StreamThreshold int
+	// DisableHTMLEscape disables escaping of the `<`, `>` and `&` characters.
+	DisableHTMLEscape bool
+	// Indent indents the output with the provided string, like "  ".
+	Indent string
+	// Encode replaces the default `encoding/json` engine.
+	Encode func(w io.Writer, v interface{}) error
+}
+
+var defaultJSONConfig = &JSONConfig{}
+
+func (c *JSONConfig) threshold() int {
+	if c.Stream {
+		return 0
+	}
+	if c.StreamThreshold > 0 {
+		return c.StreamThreshold
+	}
+	return -1
+}
+
+func (c *JSONConfig) encode(w io.Writer, v interface{}) error {
+	if c.Encode != nil {
+		return c.Encode(w, v)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(!c.DisableHTMLEscape)
+	if c.Indent != "" {
+		enc.SetIndent("", c.Indent)
+	}
+	return enc.Encode(v)
+}
+
+// A jsonWriter buffers the JSON output until the threshold is exceeded, then
+// it sends the response header and writes the output to the response writer directly.
+type jsonWriter struct {
+	ctx       *Context
+	status    int
+	buf       *bytes.Buffer
+	threshold int // negative means never
+	committed bool
+}
+
+func (w *jsonWriter) Write(p []byte) (int, error) {
+	if w.committed {
+		return w.ctx.W.Write(p)
+	}
+	if w.threshold < 0 || w.buf.Len()+len(p) <= w.threshold {
+		return w.buf.Write(p)
+	}
+	w.commit(-1)
+	return w.ctx.W.Write(p)
+}
+
+// commit sends the response header and the buffered output, a negative size means unknown.
+func (w *jsonWriter) commit(size int64) {
+	w.committed = true
+	w.ctx.autoCompress(size)
+	if w.status >= 100 {
+		w.ctx.W.WriteHeader(w.status)
+	}
+	if w.buf.Len() > 0 {
+		io.Copy(w.ctx.W, w.buf)
+	}
+}
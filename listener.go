@@ -0,0 +1,165 @@
+package rex
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/netutil"
+)
+
+// httpListener returns the listener of the HTTP server by the priority: the custom
+// listener, the systemd socket, the unix socket and the TCP port. It returns nil
+// if the HTTP server is disabled.
+func (config *ServerConfig) httpListener() (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if config.Listener != nil {
+		ln = config.Listener
+	} else if config.SystemdSocket {
+		ln, err = systemdListener("http", 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		if config.Socket != "" {
+			ln, err = listenUnix(config.Socket, os.FileMode(config.SocketMode))
+		} else if config.Port > 0 {
+			ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port))
+		}
+	}
+	if err != nil || ln == nil {
+		return nil, err
+	}
+	return config.wrapListener(ln)
+}
+
+// httpsListener returns the listener of the HTTPS server by the priority: the custom
+// listener, the systemd socket and the TCP port.
+func (config *ServerConfig) httpsListener() (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if config.TLS.Listener != nil {
+		ln = config.TLS.Listener
+	} else if config.SystemdSocket {
+		ln, err = systemdListener("https", 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		port := config.TLS.Port
+		if port == 0 {
+			port = 443
+		}
+		ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, port))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config.wrapListener(ln)
+}
+
+// wrapListener wraps the listener to limit the concurrent connections and to
+// accept the PROXY protocol if they are enabled.
+func (config *ServerConfig) wrapListener(ln net.Listener) (net.Listener, error) {
+	if config.MaxConns > 0 {
+		ln = netutil.LimitListener(ln, int(config.MaxConns))
+	}
+	if config.ProxyProtocol.Enable {
+		pln, err := newProxyListener(ln, config.ProxyProtocol)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return pln, nil
+	}
+	return ln, nil
+}
+
+// listenUnix announces on the unix domain socket, the stale socket file is removed.
+func listenUnix(socket string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' is not a socket", socket)
+		}
+		os.Remove(socket)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(socket, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners []net.Listener
+	systemdNames     []string
+	systemdErr       error
+)
+
+// systemdListener returns the socket passed by the systemd socket activation, the
+// socket is selected by the `FileDescriptorName` ("http" or "https"), or the index
+// if no sockets are named so.
+func systemdListener(name string, index int) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			// the passed file descriptors start at 3
+			f := os.NewFile(uintptr(3+i), "systemd-socket-"+strconv.Itoa(i))
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				systemdErr = fmt.Errorf("systemd socket %d: %v", i, err)
+				return
+			}
+			fdName := ""
+			if i < len(names) {
+				fdName = names[i]
+			}
+			systemdListeners = append(systemdListeners, ln)
+			systemdNames = append(systemdNames, fdName)
+		}
+		// don't pass the sockets to the child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	// select by the names if any socket is named "http" or "https", otherwise by the index
+	named := false
+	for i, fdName := range systemdNames {
+		if fdName == name {
+			return systemdListeners[i], nil
+		}
+		if fdName == "http" || fdName == "https" {
+			named = true
+		}
+	}
+	if !named && index < len(systemdListeners) {
+		return systemdListeners[index], nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,157 @@
+package rex
+
+import (
+	"bytes"
+	"html/template"
+	iofs "io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// ListingConfig contains options for the directory listing of FS.
+type ListingConfig struct {
+	// Enable renders the directory listing when the directory has no index.html.
+	Enable bool
+	// SortBy sorts the entries by "name"(default), "size" or "mtime",
+	// it can be overridden by the `sort` query.
+	SortBy string
+	// Desc sorts the entries in descending order, it can be overridden by
+	// the `order` query ("asc" or "desc").
+	Desc bool
+	// ShowHidden shows the files whose name starts with ".".
+	ShowHidden bool
+	// Template renders the HTML listing with the *Listing data.
+	Template Tpl
+}
+
+// Listing contains the entries of a directory.
+type Listing struct {
+	Path    string         `json:"path"`
+	Parent  string         `json:"parent,omitempty"`
+	Entries []ListingEntry `json:"entries"`
+}
+
+// ListingEntry contains the info of a directory entry.
+type ListingEntry struct {
+	Name    string    `json:"name"`
+	Href    string    `json:"href"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+var defaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+<style>body{font-family:sans-serif}td{padding:2px 12px 2px 0}</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th align="left"><a href="?sort=name">Name</a></th><th align="left"><a href="?sort=size">Size</a></th><th align="left"><a href="?sort=mtime">Modified</a></th></tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (ctx *Context) listDir(r *fs, dir string) {
+	config := r.config.Listing
+	entries, err := iofs.ReadDir(r.fsys, dir)
+	if err != nil {
+		ctx.ejson(internalError(err))
+		return
+	}
+
+	urlPath := utils.CleanPath(ctx.R.URL.Path)
+	listing := &Listing{
+		Path:    urlPath,
+		Entries: make([]ListingEntry, 0, len(entries)),
+	}
+	if urlPath != "/" {
+		listing.Parent = escapePath(path.Dir(strings.TrimSuffix(urlPath, "/")))
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if (strings.HasPrefix(name, ".") && !config.ShowHidden) || !r.allowed(path.Join(dir, name)) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		href := escapePath(path.Join(urlPath, name))
+		if entry.IsDir() {
+			href += "/"
+		}
+		listing.Entries = append(listing.Entries, ListingEntry{
+			Name:    name,
+			Href:    href,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			IsDir:   entry.IsDir(),
+		})
+	}
+
+	sortBy := config.SortBy
+	if s := ctx.R.URL.Query().Get("sort"); s != "" {
+		sortBy = s
+	}
+	desc := config.Desc
+	switch ctx.R.URL.Query().Get("order") {
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	}
+	sort.SliceStable(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch sortBy {
+		case "size":
+			return a.Size < b.Size
+		case "mtime":
+			return a.ModTime.Before(b.ModTime)
+		default:
+			return a.Name < b.Name
+		}
+	})
+
+	if ctx.R.URL.Query().Get("format") == "json" || strings.Contains(ctx.R.Header.Get("Accept"), "application/json") {
+		ctx.json(listing, 200)
+		return
+	}
+
+	var tpl Tpl = defaultListingTemplate
+	if config.Template != nil {
+		tpl = config.Template
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tpl.Execute(buf, listing); err != nil {
+		ctx.ejson(internalError(err))
+		return
+	}
+	ctx.end(&contentful{name: "index.html", mtime: time.Now(), content: bytes.NewReader(buf.Bytes())})
+}
+
+// escapePath escapes the segments of the path to be used as a href.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
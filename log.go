@@ -0,0 +1,39 @@
+package rex
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// the levels of the messages logged by rex
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal
+)
+
+var logLevels = map[string]int32{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+	"fatal": levelFatal,
+}
+
+// logLevel is the minimum level of the messages to log, it's set by the `LogLevel`
+// config and may be changed by the config reload while the requests are served.
+var logLevel atomic.Int32
+
+// setLogLevel sets the minimum level of the messages to log, default is "debug".
+func setLogLevel(name string) {
+	logLevel.Store(logLevels[strings.ToLower(name)])
+}
+
+// logf prints the message to the logger if the level is enabled.
+func logf(logger Logger, level int32, format string, v ...interface{}) {
+	if logger != nil && level >= logLevel.Load() {
+		logger.Printf(format, v...)
+	}
+}
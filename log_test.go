@@ -0,0 +1,40 @@
+package rex
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+type bufferLogger []string
+
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestLogLevel(t *testing.T) {
+	defer setLogLevel("")
+	logger := &bufferLogger{}
+	api := &APIHandler{}
+	api.Use(ErrorLogger(logger))
+	api.Query("*", func(ctx *Context) interface{} {
+		return errors.New("oops")
+	})
+	for _, c := range []struct {
+		level string
+		logs  int
+	}{
+		{"", 1},
+		{"warn", 1},
+		{"error", 1},
+		{"fatal", 0},
+	} {
+		*logger = nil
+		setLogLevel(c.level)
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if len(*logger) != c.logs {
+			t.Fatalf("level %q: got %d logs %v, want %d", c.level, len(*logger), *logger, c.logs)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package rex
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/ije/gox/utils"
 	"github.com/ije/rex/session"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Header is REX middleware to set http header
@@ -174,7 +182,7 @@ func BasicAuthWithRealm(realm string, auth func(name string, secret string) (ok
 				name, secret := utils.SplitByFirstByte(string(authInfo), ':')
 				ok, err := auth(name, secret)
 				if err != nil {
-					return &Error{500, err.Error()}
+					return internalError(err)
 				}
 				if ok {
 					ctx.basicAuthUser = name
@@ -191,10 +199,169 @@ func BasicAuthWithRealm(realm string, auth func(name string, secret string) (ok
 	}
 }
 
+// ClientCertAuth returns a middleware that maps the verified client certificate of
+// the mutual TLS to an ACLUser, the client without a verified certificate gets 401
+// and the nil user gets 403.
+func ClientCertAuth(auth func(cert *x509.Certificate) (ACLUser, error)) Handle {
+	return func(ctx *Context) interface{} {
+		cert := ctx.ClientCert()
+		if cert == nil {
+			return &Error{Status: 401, Message: "client certificate required"}
+		}
+		user, err := auth(cert)
+		if err != nil {
+			return internalError(err)
+		}
+		if user == nil {
+			return &Error{Status: 403, Message: "forbidden"}
+		}
+		ctx.aclUser = user
+		return nil
+	}
+}
+
+// CertUser is the ACLUser of a client certificate.
+type CertUser struct {
+	Name        string
+	Cert        *x509.Certificate
+	permissions []string
+}
+
+// Permissions returns the permission IDs
+func (u *CertUser) Permissions() []string {
+	return u.permissions
+}
+
+// ClientCertPermissions returns a ClientCertAuth middleware that grants the permissions
+// by the certificate identities: the subject common name, the DNS names, the URIs
+// (like "spiffe://example.org/billing") and the email addresses.
+func ClientCertPermissions(permissions map[string][]string) Handle {
+	return ClientCertAuth(func(cert *x509.Certificate) (ACLUser, error) {
+		names := []string{cert.Subject.CommonName}
+		names = append(names, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		for _, name := range names {
+			if p, ok := permissions[name]; ok && name != "" {
+				return &CertUser{Name: name, Cert: cert, permissions: p}, nil
+			}
+		}
+		return nil, nil
+	})
+}
+
 // AutoCompress is REX middleware to enable compress by content type and client `Accept-Encoding`
-func AutoCompress() Handle {
+func AutoCompress(config ...CompressionConfig) Handle {
+	c := &CompressionConfig{}
+	if len(config) > 0 {
+		c = &config[0]
+	}
+	return func(ctx *Context) interface{} {
+		ctx.compression = c
+		return nil
+	}
+}
+
+// JSON returns a JSON middleware to set the JSON encoding options, like streaming.
+func JSON(config JSONConfig) Handle {
+	return func(ctx *Context) interface{} {
+		ctx.jsonConfig = &config
+		return nil
+	}
+}
+
+// WriteTimeout returns a middleware that overrides the `WriteTimeout` of the server
+// for the endpoint, like the long-lived streams(SSE). Zero means no timeout.
+func WriteTimeout(timeout time.Duration) Handle {
+	return func(ctx *Context) interface{} {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		err := http.NewResponseController(ctx.W).SetWriteDeadline(deadline)
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return internalError(err)
+		}
+		return nil
+	}
+}
+
+// Timeout returns a middleware that cancels the request context after the timeout,
+// the handles should watch the `ctx.Done()` or pass the ctx to the downstream calls.
+// When the handle returns after the timeout, its response is replaced with 503. The
+// handle is not interrupted, the one ignoring the `ctx.Done()` runs to the end.
+func Timeout(timeout time.Duration) Handle {
 	return func(ctx *Context) interface{} {
-		ctx.autoCompress = true
+		c, cancel := context.WithTimeout(ctx.reqContext, timeout)
+		if prev := ctx.cancel; prev != nil {
+			ctx.cancel = func() {
+				cancel()
+				prev()
+			}
+		} else {
+			ctx.cancel = cancel
+		}
+		ctx.reqContext = c
+		ctx.R = ctx.R.WithContext(c)
+		ctx.form.R = ctx.R
 		return nil
 	}
 }
+
+// Decompress returns a Decompress middleware to decompress the request body by the
+// `Content-Encoding` header(gzip, br or zstd), the decompressed body is limited by
+// the maxSize(default is 32MB) to prevent zip bombs. The handle returning the error
+// of reading the oversized body replies 413.
+func Decompress(maxSize int64) Handle {
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+	return func(ctx *Context) interface{} {
+		encoding := strings.ToLower(strings.TrimSpace(ctx.R.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || ctx.R.Body == nil || ctx.R.Body == http.NoBody {
+			return nil
+		}
+
+		var body io.ReadCloser
+		switch encoding {
+		case "gzip", "x-gzip":
+			r, err := gzip.NewReader(ctx.R.Body)
+			if err != nil {
+				return &Error{Status: 400, Message: "invalid gzip body"}
+			}
+			body = r
+		case "br":
+			body = io.NopCloser(brotli.NewReader(ctx.R.Body))
+		case "zstd":
+			r, err := zstd.NewReader(ctx.R.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+			if err != nil {
+				return &Error{Status: 400, Message: "invalid zstd body"}
+			}
+			body = r.IOReadCloser()
+		default:
+			ctx.SetHeader("Accept-Encoding", "gzip, br, zstd")
+			return &Error{Status: http.StatusUnsupportedMediaType, Message: fmt.Sprintf("unsupported content encoding '%s'", encoding)}
+		}
+
+		ctx.R.Body = &decompressedBody{http.MaxBytesReader(ctx.W, body, maxSize), body, ctx.R.Body}
+		ctx.R.ContentLength = -1
+		ctx.R.Header.Del("Content-Encoding")
+		ctx.R.Header.Del("Content-Length")
+		return nil
+	}
+}
+
+const defaultMaxDecompressedSize = 32 << 20 // 32 MB
+
+type decompressedBody struct {
+	io.Reader
+	decoder io.Closer
+	raw     io.Closer
+}
+
+func (b *decompressedBody) Close() error {
+	b.decoder.Close()
+	return b.raw.Close()
+}
@@ -2,28 +2,111 @@ package rex
 
 import (
 	"fmt"
+	"net"
 	"net/http"
-
-	"github.com/ije/gox/valid"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type mux struct {
 	forceHTTPS bool
+	httpsPort  uint16
+	hsts       string
+	live       *atomic.Value
+	proxies    *proxyList // the trusted proxies of the listener
+	handler    *APIHandler
+	vhosts     *vhosts
 }
 
 func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	header := w.Header()
-	header.Set("Connection", "keep-alive")
 	header.Set("Server", "rex")
 
-	if m.forceHTTPS && r.TLS == nil && r.Host != "localhost" && !valid.IsIPv4(r.Host) {
-		code := 301
-		if r.Method != "GET" {
-			code = 307
+	if r.TLS != nil && m.hsts != "" {
+		header.Set("Strict-Transport-Security", m.hsts)
+	}
+
+	if m.forceHTTPS && r.TLS == nil {
+		if url, ok := m.httpsURL(r); ok {
+			code := 301
+			if r.Method != "GET" {
+				code = 307
+			}
+			http.Redirect(w, r, url, code)
+			return
+		}
+	}
+
+	if m.live != nil {
+		live := m.live.Load().(*liveConfig)
+		if live.deadlines {
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(deadlineOf(live.readTimeout))
+			rc.SetWriteDeadline(deadlineOf(live.writeTimeout))
+		}
+		if live.cors != nil {
+			if status, ok := live.cors(&Context{W: w, R: r}).(int); ok {
+				w.WriteHeader(status)
+				return
+			}
 		}
-		http.Redirect(w, r, fmt.Sprintf("https://%s%s", r.Host, r.RequestURI), code)
-		return
 	}
 
-	defaultAPIHanlder.ServeHTTP(w, r)
+	handler := m.handlerOf(r)
+	proxies := m.proxies
+	if proxies == nil {
+		proxies = handler.trustedProxies
+	}
+	handler.serve(w, r, proxies)
+}
+
+// handlerOf returns the APIHandler of the request by the virtual hosts, the
+// handler of the listener serves the unmatched hosts.
+func (m *mux) handlerOf(r *http.Request) *APIHandler {
+	if m.vhosts != nil {
+		if handler := m.vhosts.match(r.Host); handler != nil {
+			return handler
+		}
+	}
+	if m.handler != nil {
+		return m.handler
+	}
+	return defaultAPIHanlder
+}
+
+// deadlineOf returns the deadline of the timeout, zero means no deadline.
+func deadlineOf(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// httpsURL returns the HTTPS URL of the request, the port of the HTTP server is
+// replaced with the HTTPS port. The localhost and the IP hosts are not redirected.
+func (m *mux) httpsURL(r *http.Request) (string, bool) {
+	host := hostOf(r.Host)
+	if host == "" || host == "localhost" || net.ParseIP(host) != nil {
+		return "", false
+	}
+	if m.httpsPort != 0 && m.httpsPort != 443 {
+		host = fmt.Sprintf("%s:%d", host, m.httpsPort)
+	}
+	return "https://" + host + r.URL.RequestURI(), true
+}
+
+// hstsHeader returns the value of the `Strict-Transport-Security` header.
+func (config HSTSConfig) hstsHeader() string {
+	if config.MaxAge == 0 {
+		return ""
+	}
+	directives := []string{fmt.Sprintf("max-age=%d", config.MaxAge)}
+	if config.IncludeSubDomains {
+		directives = append(directives, "includeSubDomains")
+	}
+	if config.Preload {
+		directives = append(directives, "preload")
+	}
+	return strings.Join(directives, "; ")
 }
@@ -2,6 +2,7 @@ package rex
 
 import (
 	"fmt"
+	"strings"
 )
 
 // A Form to handle request path.
@@ -38,3 +39,15 @@ func (path *Path) RequireSegment(index int) string {
 	}
 	return value
 }
+
+// splitPath appends the segments of the path to dst without allocating substrings.
+func splitPath(dst []string, path string) []string {
+	for {
+		i := strings.IndexByte(path, '/')
+		if i < 0 {
+			return append(dst, path)
+		}
+		dst = append(dst, path[:i])
+		path = path[i+1:]
+	}
+}
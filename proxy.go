@@ -0,0 +1,188 @@
+package rex
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// A proxyList contains the trusted proxies.
+type proxyList struct {
+	nets []*net.IPNet
+	// unix trusts the peers of the unix domain sockets, which have no IP.
+	unix bool
+}
+
+// parseTrustedProxies parses the CIDRs or IPs of the trusted proxies, the "unix"
+// entry trusts the peers of the unix domain sockets.
+func parseTrustedProxies(proxies []string) (*proxyList, error) {
+	list := &proxyList{nets: make([]*net.IPNet, 0, len(proxies))}
+	for _, s := range proxies {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if s == "unix" {
+			list.unix = true
+			continue
+		}
+		if !strings.ContainsRune(s, '/') {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			list.nets = append(list.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", s)
+		}
+		list.nets = append(list.nets, ipnet)
+	}
+	return list, nil
+}
+
+func (l *proxyList) empty() bool {
+	return l == nil || (len(l.nets) == 0 && !l.unix)
+}
+
+func (l *proxyList) contains(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	for _, ipnet := range l.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy checks whether the ip is a trusted proxy.
+func (ctx *Context) isTrustedProxy(ip string) bool {
+	return ctx.trustedProxies.contains(net.ParseIP(ip))
+}
+
+// isTrustedPeer checks whether the peer of the connection is a trusted proxy,
+// the peer without IP is from a unix domain socket.
+func (ctx *Context) isTrustedPeer() bool {
+	ip := hostOf(ctx.R.RemoteAddr)
+	if net.ParseIP(ip) == nil {
+		return ctx.trustedProxies != nil && ctx.trustedProxies.unix
+	}
+	return ctx.isTrustedProxy(ip)
+}
+
+// RemoteIP returns the remote client IP. The `Forwarded`, `X-Forwarded-For` and
+// `X-Real-IP` headers are only used when the request comes from a trusted proxy,
+// the forwarded chain is walked from right to left, the first untrusted IP is the client IP.
+func (ctx *Context) RemoteIP() string {
+	ip := hostOf(ctx.R.RemoteAddr)
+	if !ctx.isTrustedPeer() {
+		return ip
+	}
+
+	chain := forwardedValues(ctx.R.Header.Values("Forwarded"), "for")
+	if len(chain) == 0 {
+		for _, v := range ctx.R.Header.Values("X-Forwarded-For") {
+			for _, p := range strings.Split(v, ",") {
+				chain = append(chain, hostOf(strings.TrimSpace(p)))
+			}
+		}
+	}
+	if len(chain) > 0 {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if net.ParseIP(chain[i]) == nil {
+				// obfuscated or unknown node, the chain can't be trusted anymore
+				return ip
+			}
+			ip = chain[i]
+			if !ctx.isTrustedProxy(ip) {
+				return ip
+			}
+		}
+		return ip
+	}
+
+	if realIP := hostOf(strings.TrimSpace(ctx.R.Header.Get("X-Real-IP"))); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// Scheme returns the request scheme ("http" or "https"), the `Forwarded` and
+// `X-Forwarded-Proto` headers are only used when the request comes from a trusted proxy.
+func (ctx *Context) Scheme() string {
+	if ctx.isTrustedPeer() {
+		proto := lastValue(forwardedValues(ctx.R.Header.Values("Forwarded"), "proto"))
+		if proto == "" {
+			proto = lastValue(strings.Split(ctx.R.Header.Get("X-Forwarded-Proto"), ","))
+		}
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if ctx.R.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Host returns the request host, the `Forwarded` and `X-Forwarded-Host` headers
+// are only used when the request comes from a trusted proxy.
+func (ctx *Context) Host() string {
+	if ctx.isTrustedPeer() {
+		host := lastValue(forwardedValues(ctx.R.Header.Values("Forwarded"), "host"))
+		if host == "" {
+			host = lastValue(strings.Split(ctx.R.Header.Get("X-Forwarded-Host"), ","))
+		}
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return ctx.R.Host
+}
+
+// forwardedValues returns the values of the parameter in the RFC 7239 `Forwarded` headers.
+func forwardedValues(headers []string, key string) []string {
+	var values []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v := utils.SplitByFirstByte(strings.TrimSpace(pair), '=')
+				if strings.EqualFold(k, key) {
+					v = strings.Trim(strings.TrimSpace(v), `"`)
+					if key == "for" {
+						v = hostOf(v)
+					}
+					values = append(values, v)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// hostOf returns the host of the address without the port and the IPv6 brackets,
+// like "1.2.3.4:80" => "1.2.3.4", "[::1]:80" => "::1".
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
@@ -0,0 +1,154 @@
+package rex
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketPeer(t *testing.T) {
+	for i, c := range []struct {
+		proxies []string
+		want    string
+	}{
+		{nil, "@ http"},
+		{[]string{"127.0.0.1"}, "@ http"},
+		{[]string{"unix"}, "203.0.113.7 https"},
+	} {
+		sock := filepath.Join(t.TempDir(), "rex.sock")
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api := &APIHandler{}
+		if err := api.SetTrustedProxies(c.proxies...); err != nil {
+			t.Fatal(err)
+		}
+		api.Query("*", func(ctx *Context) interface{} {
+			return ctx.RemoteIP() + " " + ctx.Scheme()
+		})
+		go http.Serve(ln, api)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", sock)
+			},
+		}}
+		req, _ := http.NewRequest("GET", "http://rex/", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		ln.Close()
+		if string(data) != c.want {
+			t.Fatalf("#%d trusted proxies %q: got %q, want %q", i, c.proxies, data, c.want)
+		}
+	}
+}
+
+func TestMuxTrustedProxies(t *testing.T) {
+	api := &APIHandler{}
+	api.SetTrustedProxies("10.0.0.1")
+	api.Query("*", func(ctx *Context) interface{} {
+		return ctx.RemoteIP()
+	})
+	listenerProxies, _ := parseTrustedProxies([]string{"10.0.0.2"})
+	for i, c := range []struct {
+		proxies *proxyList
+		peer    string
+		want    string
+	}{
+		{nil, "10.0.0.1:1234", "203.0.113.7"},
+		{nil, "10.0.0.2:1234", "10.0.0.2"},
+		{listenerProxies, "10.0.0.1:1234", "10.0.0.1"},
+		{listenerProxies, "10.0.0.2:1234", "203.0.113.7"},
+	} {
+		m := &mux{proxies: c.proxies, handler: api}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		r.Header.Set("X-Forwarded-For", "203.0.113.7")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		if w.Body.String() != c.want {
+			t.Errorf("#%d: got %q, want %q", i, w.Body.String(), c.want)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"203.0.113.7:1234", nil, "203.0.113.7"},
+		{"203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, unknown"}, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "bad"}, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=1.2.3.4;proto=https, for=10.0.0.2`, "X-Forwarded-For": "6.6.6.6"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"[fd00::1]:1234", map[string]string{"Forwarded": `for="[2001:db8::1]"`}, "2001:db8::1"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=_hidden`}, "10.0.0.1"},
+		{"[2001:db8::2]:1234", map[string]string{"Forwarded": `for=1.2.3.4`}, "2001:db8::2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		for key, value := range c.headers {
+			r.Header.Set(key, value)
+		}
+		ctx := &Context{R: r, trustedProxies: proxies}
+		if got := ctx.RemoteIP(); got != c.want {
+			t.Errorf("#%d: got %q, want %q", i, got, c.want)
+		}
+	}
+}
+
+func TestSchemeAndHost(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		peer    string
+		headers map[string]string
+		scheme  string
+		host    string
+	}{
+		{"203.0.113.7:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"}, "http", "example.com"},
+		{"10.0.0.1:1234", nil, "http", "example.com"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example.com"}, "https", "api.example.com"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "http, HTTPS", "X-Forwarded-Host": "a.com, b.com"}, "https", "b.com"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "ftp"}, "http", "example.com"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `proto=https;host="api.example.com"`, "X-Forwarded-Proto": "http"}, "https", "api.example.com"},
+	} {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = c.peer
+		for key, value := range c.headers {
+			r.Header.Set(key, value)
+		}
+		ctx := &Context{R: r, trustedProxies: proxies}
+		if got := ctx.Scheme(); got != c.scheme {
+			t.Errorf("#%d Scheme: got %q, want %q", i, got, c.scheme)
+		}
+		if got := ctx.Host(); got != c.host {
+			t.Errorf("#%d Host: got %q, want %q", i, got, c.host)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package rex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolConfig contains options to accept the PROXY protocol (v1 and v2)
+// sent by the TCP load balancers, like HAProxy or AWS NLB.
+type ProxyProtocolConfig struct {
+	Enable bool `json:"enable"`
+	// TrustedSources lists the CIDRs or IPs of the load balancers, the PROXY header
+	// from other sources is not parsed. It's required to enable the PROXY protocol,
+	// use "0.0.0.0/0" and "::/0" to trust all the sources explicitly, and "unix" to
+	// trust the peers of the unix domain socket.
+	TrustedSources []string `json:"trustedSources"`
+	// HeaderTimeout is the timeout in seconds to read the PROXY header, default is 10.
+	HeaderTimeout uint32 `json:"headerTimeout"`
+}
+
+var (
+	proxyV1Prefix          = []byte("PROXY ")
+	proxyV2Sig             = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader         = errors.New("invalid PROXY protocol header")
+	errMissingProxySources = errors.New("PROXY protocol: missing the trusted sources")
+)
+
+// A proxyListener wraps a net.Listener to accept the PROXY protocol.
+type proxyListener struct {
+	net.Listener
+	trusted *proxyList
+	timeout time.Duration
+}
+
+func newProxyListener(ln net.Listener, config ProxyProtocolConfig) (net.Listener, error) {
+	trusted, err := parseTrustedProxies(config.TrustedSources)
+	if err != nil {
+		return nil, err
+	}
+	if trusted.empty() {
+		return nil, errMissingProxySources
+	}
+	timeout := time.Duration(config.HeaderTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &proxyListener{ln, trusted, timeout}, nil
+}
+
+// Accept waits for and returns the next connection, the PROXY header is read
+// lazily to not block the accept loop.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return l.trusted.contains(a.IP)
+	case *net.UnixAddr:
+		return l.trusted.unix
+	}
+	return false
+}
+
+// A proxyConn reads the PROXY header on the first Read or RemoteAddr call.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	if sig, err := c.reader.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(sig, proxyV1Prefix) {
+		c.remoteAddr, c.err = readProxyV1(c.reader)
+		return
+	}
+	if sig, err := c.reader.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+		c.remoteAddr, c.err = readProxyV2(c.reader)
+	}
+}
+
+// readProxyV1 reads the human-readable header, like
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// the LOCAL command is used by the health checks of the load balancer
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// AF_UNSPEC or AF_UNIX
+	return nil, nil
+}
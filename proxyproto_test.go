@@ -0,0 +1,85 @@
+package rex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   string // the remote address, "error" for the invalid headers
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", ""},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "error"},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "error"},
+		{"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n", "error"},
+		{"PROXY TCP4 bad 192.168.0.11 56324 443\r\n", "error"},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n", "error"},
+		{"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "error"},
+	} {
+		addr, err := readProxyV1(bufio.NewReader(strings.NewReader(c.header + "GET / HTTP/1.1\r\n")))
+		if got := addrString(addr, err); got != c.want {
+			t.Errorf("readProxyV1(%q): got %q, want %q", c.header, got, c.want)
+		}
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	v4 := make([]byte, 12)
+	copy(v4, net.ParseIP("192.168.0.1").To4())
+	copy(v4[4:], net.ParseIP("192.168.0.11").To4())
+	binary.BigEndian.PutUint16(v4[8:], 56324)
+	binary.BigEndian.PutUint16(v4[10:], 443)
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 56324)
+	binary.BigEndian.PutUint16(v6[34:], 443)
+
+	for _, c := range []struct {
+		name   string
+		header []byte
+		want   string // the remote address, "error" for the invalid headers
+	}{
+		{"IPv4", proxyV2Header(0x21, 0x11, v4), "192.168.0.1:56324"},
+		{"IPv6", proxyV2Header(0x21, 0x21, v6), "[2001:db8::1]:56324"},
+		{"IPv4 with TLVs", proxyV2Header(0x21, 0x11, append(v4, 0x04, 0x00, 0x01, 0x00)), "192.168.0.1:56324"},
+		{"LOCAL", proxyV2Header(0x20, 0x00, nil), ""},
+		{"LOCAL with address", proxyV2Header(0x20, 0x11, v4), ""},
+		{"AF_UNSPEC", proxyV2Header(0x21, 0x00, nil), ""},
+		{"version 1", proxyV2Header(0x11, 0x11, v4), "error"},
+		{"short IPv4", proxyV2Header(0x21, 0x11, v4[:8]), "error"},
+		{"short IPv6", proxyV2Header(0x21, 0x21, v4), "error"},
+		{"truncated", proxyV2Header(0x21, 0x11, v4)[:20], "error"},
+	} {
+		addr, err := readProxyV2(bufio.NewReader(bytes.NewReader(c.header)))
+		if got := addrString(addr, err); got != c.want {
+			t.Errorf("readProxyV2(%s): got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func proxyV2Header(verCmd byte, famProto byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Sig...)
+	header = append(header, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func addrString(addr net.Addr, err error) string {
+	if err != nil {
+		return "error"
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -4,72 +4,136 @@ package rex
 import (
 	"fmt"
 	"net/http"
-	"os"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-// Serve serves a rex server.
+// Serve serves a rex server, the listeners declared by the `Listeners` are served
+// as well and their errors are sent to the returned channel.
 func Serve(config ServerConfig) chan error {
-	c := make(chan error, 1)
+	lives := make([]*atomic.Value, len(config.Listeners)+1)
+	for i := range lives {
+		lives[i] = &atomic.Value{}
+	}
+	lives[0].Store(config.liveConfig(&config))
+	for i := range config.Listeners {
+		lives[i+1].Store(config.Listeners[i].liveConfig(&config.Listeners[i]))
+	}
+	if config.LogLevel != "" {
+		setLogLevel(config.LogLevel)
+	}
+	if config.loaded {
+		config.watchReload(lives)
+	}
 
-	if config.Port > 0 {
+	c := config.serve(lives[0])
+	for i, listener := range config.Listeners {
+		lc := listener.serve(lives[i+1])
 		go func() {
-			serv := &http.Server{
-				Addr:           fmt.Sprintf(("%s:%d"), config.Host, config.Port),
-				Handler:        &mux{config.TLS.AutoRedirect},
-				ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
-				WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
-				MaxHeaderBytes: int(config.MaxHeaderBytes),
+			for err := range lc {
+				c <- err
 			}
-			err := serv.ListenAndServe()
+		}()
+	}
+	return c
+}
+
+// serve serves the server without its `Listeners`, the live holds the settings
+// reloaded on SIGHUP.
+func (config ServerConfig) serve(live *atomic.Value) chan error {
+	c := make(chan error, 2)
+
+	handler := config.Handler
+	if handler == nil {
+		handler = defaultAPIHanlder
+	}
+	var vh *vhosts
+	if len(config.VirtualHosts) > 0 {
+		var err error
+		vh, err = newVHosts(config.VirtualHosts)
+		if err != nil {
+			c <- err
+			return c
+		}
+	}
+
+	// the trusted proxies of the listener override the ones of the handlers
+	var proxies *proxyList
+	if len(config.TrustedProxies) > 0 {
+		var err error
+		proxies, err = parseTrustedProxies(config.TrustedProxies)
+		if err != nil {
+			c <- err
+			return c
+		}
+	}
+
+	m, err := config.autocertManager()
+	if err != nil {
+		c <- fmt.Errorf("rex server(https) shutdown: %v", err)
+		return c
+	}
+
+	ln, err := config.httpListener()
+	if err != nil {
+		c <- fmt.Errorf("rex server shutdown: %v", err)
+		return c
+	}
+	if ln != nil {
+		go func() {
+			var handler http.Handler = &mux{
+				forceHTTPS: config.TLS.AutoRedirect,
+				httpsPort:  config.TLS.Port,
+				live:       live,
+				proxies:    proxies,
+				handler:    handler,
+				vhosts:     vh,
+			}
+			if m != nil {
+				// answer the ACME HTTP-01 challenges before the redirection
+				handler = m.HTTPHandler(handler)
+			}
+			if config.H2C {
+				handler = h2c.NewHandler(handler, config.http2Server())
+			}
+			err := config.httpServer(handler).Serve(ln)
 			if err != nil {
 				c <- fmt.Errorf("rex server shutdown: %v", err)
 			}
 		}()
 	}
 
-	if https := config.TLS; https.AutoTLS.AcceptTOS || (https.CertFile != "" && https.KeyFile != "") {
+	if https := config.TLS; https.AutoTLS.AcceptTOS || (https.CertFile != "" && https.KeyFile != "") || len(https.Certificates) > 0 {
 		go func() {
-			port := https.Port
-			if port == 0 {
-				port = 443
-			}
-			servs := &http.Server{
-				Addr:           fmt.Sprintf(("%s:%d"), config.Host, port),
-				Handler:        &mux{},
-				ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
-				WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
-				MaxHeaderBytes: int(config.MaxHeaderBytes),
+			servs := config.httpServer(&mux{
+				hsts:    config.TLS.HSTS.hstsHeader(),
+				live:    live,
+				proxies: proxies,
+				handler: handler,
+				vhosts:  vh,
+			})
+			tlsConfig, err := config.tlsConfig(m)
+			if err != nil {
+				c <- fmt.Errorf("rex server(https) shutdown: %v", err)
+				return
 			}
-			if https.AutoTLS.AcceptTOS {
-				m := &autocert.Manager{
-					Prompt: autocert.AcceptTOS,
-				}
-				if https.AutoTLS.Cache != nil {
-					m.Cache = https.AutoTLS.Cache
-				} else if cacheDir := https.AutoTLS.CacheDir; cacheDir != "" {
-					fi, err := os.Stat(cacheDir)
-					if err == nil && !fi.IsDir() {
-						c <- fmt.Errorf("AutoTLS: invalid cache dir '%s'", cacheDir)
-						return
-					}
-					if err != nil && os.IsNotExist(err) {
-						err = os.MkdirAll(cacheDir, 0755)
-						if err != nil {
-							c <- fmt.Errorf("[error] AutoTLS: can't create the cache dir '%s'", cacheDir)
-							return
-						}
-					}
-					m.Cache = autocert.DirCache(cacheDir)
+			servs.TLSConfig = tlsConfig
+			if config.HTTP2 != (HTTP2Config{}) {
+				err := http2.ConfigureServer(servs, config.http2Server())
+				if err != nil {
+					c <- fmt.Errorf("rex server(https) shutdown: %v", err)
+					return
 				}
-				if len(https.AutoTLS.Hosts) > 0 {
-					m.HostPolicy = autocert.HostWhitelist(https.AutoTLS.Hosts...)
-				}
-				servs.TLSConfig = m.TLSConfig()
 			}
-			err := servs.ListenAndServeTLS(https.CertFile, https.KeyFile)
+			ln, err := config.httpsListener()
+			if err != nil {
+				c <- fmt.Errorf("rex server(https) shutdown: %v", err)
+				return
+			}
+			err = servs.ServeTLS(ln, "", "")
 			if err != nil {
 				c <- fmt.Errorf("rex server(https) shutdown: %v", err)
 			}
@@ -79,6 +143,29 @@ func Serve(config ServerConfig) chan error {
 	return c
 }
 
+func (config *ServerConfig) httpServer(handler http.Handler) *http.Server {
+	serv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    int(config.MaxHeaderBytes),
+	}
+	if config.DisableKeepAlives {
+		serv.SetKeepAlivesEnabled(false)
+	}
+	return serv
+}
+
+func (config *ServerConfig) http2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: config.HTTP2.MaxConcurrentStreams,
+		MaxReadFrameSize:     config.HTTP2.MaxReadFrameSize,
+		IdleTimeout:          time.Duration(config.HTTP2.IdleTimeout) * time.Second,
+	}
+}
+
 // Start starts a REX server.
 func Start(port uint16) chan error {
 	return Serve(ServerConfig{
@@ -0,0 +1,237 @@
+package rex
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertManager returns the autocert.Manager if the AutoTLS is enabled, it's
+// shared by the HTTPS server and the HTTP server for the HTTP-01 challenges.
+func (config *ServerConfig) autocertManager() (*autocert.Manager, error) {
+	autoTLS := config.TLS.AutoTLS
+	if !autoTLS.AcceptTOS {
+		return nil, nil
+	}
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+	}
+	if autoTLS.Cache != nil {
+		m.Cache = autoTLS.Cache
+	} else if cacheDir := autoTLS.CacheDir; cacheDir != "" {
+		fi, err := os.Stat(cacheDir)
+		if err == nil && !fi.IsDir() {
+			return nil, fmt.Errorf("AutoTLS: invalid cache dir '%s'", cacheDir)
+		}
+		if err != nil && os.IsNotExist(err) {
+			err = os.MkdirAll(cacheDir, 0755)
+			if err != nil {
+				return nil, fmt.Errorf("AutoTLS: can't create the cache dir '%s'", cacheDir)
+			}
+		}
+		m.Cache = autocert.DirCache(cacheDir)
+	}
+	if len(autoTLS.Hosts) > 0 {
+		m.HostPolicy = autocert.HostWhitelist(autoTLS.Hosts...)
+	}
+	return m, nil
+}
+
+// tlsConfig returns the tls.Config of the HTTPS server, the certificates are
+// obtained by the autocert manager if it's not nil.
+func (config *ServerConfig) tlsConfig(m *autocert.Manager) (*tls.Config, error) {
+	https := config.TLS
+	var tlsConfig *tls.Config
+	if m != nil {
+		tlsConfig = m.TLSConfig()
+	} else {
+		var pairs []CertKeyPair
+		if https.CertFile != "" && https.KeyFile != "" {
+			pairs = append(pairs, CertKeyPair{https.CertFile, https.KeyFile})
+		}
+		pairs = append(pairs, https.Certificates...)
+		store, err := newCertStore(pairs)
+		if err != nil {
+			return nil, err
+		}
+		store.watch(time.Duration(https.WatchInterval) * time.Second)
+		tlsConfig = &tls.Config{
+			GetCertificate: store.getCertificate,
+		}
+	}
+
+	if https.MinVersion != "" {
+		version, ok := tlsVersions[https.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS version '%s'", https.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(https.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range https.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid cipher suite '%s'", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	if https.ClientCA != "" || https.ClientAuth != "" {
+		mode := https.ClientAuth
+		if mode == "" {
+			mode = "require-and-verify"
+		}
+		clientAuth, ok := clientAuthModes[mode]
+		if !ok {
+			return nil, fmt.Errorf("invalid client auth mode '%s'", mode)
+		}
+		tlsConfig.ClientAuth = clientAuth
+		if https.ClientCA != "" {
+			pem, err := os.ReadFile(https.ClientCA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("invalid client CA '%s'", https.ClientCA)
+			}
+			tlsConfig.ClientCAs = pool
+		} else if clientAuth >= tls.VerifyClientCertIfGiven {
+			return nil, errors.New("missing the client CA")
+		}
+	}
+	return tlsConfig, nil
+}
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// A certStore holds the certificates selected by SNI, the certificates are
+// reloaded when the files are changed or on SIGHUP.
+type certStore struct {
+	lock   sync.RWMutex
+	pairs  []CertKeyPair
+	certs  []*tls.Certificate
+	mtimes []time.Time
+}
+
+func newCertStore(pairs []CertKeyPair) (*certStore, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("missing the TLS certificates")
+	}
+	s := &certStore{pairs: pairs}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load loads all the certificates, the old certificates are kept if any fails.
+func (s *certStore) load() error {
+	certs := make([]*tls.Certificate, len(s.pairs))
+	mtimes := make([]time.Time, len(s.pairs))
+	for i, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return err
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+		}
+		certs[i] = &cert
+		mtimes[i] = pair.mtime()
+	}
+	s.lock.Lock()
+	s.certs = certs
+	s.mtimes = mtimes
+	s.lock.Unlock()
+	return nil
+}
+
+// changed checks whether any of the cert files is changed.
+func (s *certStore) changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i, pair := range s.pairs {
+		if !pair.mtime().Equal(s.mtimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates when the files are changed or on SIGHUP,
+// the files are checked every minute if the interval is zero.
+func (s *certStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+			case <-sig:
+			}
+			if err := s.load(); err != nil {
+				logf(defaultLogger, levelError, "[error] reload TLS certificates: %v", err)
+			}
+		}
+	}()
+}
+
+// getCertificate returns the certificate matched by the SNI, or the first one.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+func (pair CertKeyPair) mtime() time.Time {
+	var mtime time.Time
+	for _, name := range []string{pair.CertFile, pair.KeyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime
+}
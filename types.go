@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	iofs "io/fs"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -21,6 +23,63 @@ type ServerConfig struct {
 	ReadTimeout    uint32    `json:"readTimeout"`
 	WriteTimeout   uint32    `json:"writeTimeout"`
 	MaxHeaderBytes uint32    `json:"maxHeaderBytes"`
+	// TrustedProxies lists the CIDRs or IPs of the trusted proxies, the "unix" entry
+	// trusts the peers of the unix domain socket, like a local reverse proxy. They
+	// override the trusted proxies of the handlers for the requests of the listener.
+	TrustedProxies []string `json:"trustedProxies"`
+	// ProxyProtocol accepts the PROXY protocol on both the HTTP and HTTPS listeners.
+	ProxyProtocol ProxyProtocolConfig `json:"proxyProtocol"`
+	// Socket is the path of the unix domain socket to listen on instead of the port.
+	Socket string `json:"socket"`
+	// SocketMode is the permissions of the unix domain socket, like 0660.
+	SocketMode uint32 `json:"socketMode"`
+	// SystemdSocket uses the sockets passed by the systemd socket activation (LISTEN_FDS),
+	// the sockets can be named "http" and "https" by the `FileDescriptorName`.
+	SystemdSocket bool `json:"systemdSocket"`
+	// Listener is a custom listener of the HTTP server.
+	Listener net.Listener `json:"-"`
+	// H2C enables HTTP/2 over cleartext on the HTTP server, both the upgrade and
+	// the prior knowledge are supported. It's used behind a TLS-terminating proxy.
+	H2C bool `json:"h2c"`
+	// HTTP2 contains the HTTP/2 settings of both the TLS and cleartext servers.
+	HTTP2 HTTP2Config `json:"http2"`
+	// ReadHeaderTimeout is the timeout in seconds to read the request headers, it
+	// defends against the slowloris attacks without limiting the request bodies.
+	ReadHeaderTimeout uint32 `json:"readHeaderTimeout"`
+	// IdleTimeout is the timeout in seconds to wait for the next request of the
+	// keep-alive connections, default is the ReadTimeout.
+	IdleTimeout uint32 `json:"idleTimeout"`
+	// DisableKeepAlives closes the connections after each request.
+	DisableKeepAlives bool `json:"disableKeepAlives"`
+	// MaxConns is the maximum number of the concurrent connections of each listener,
+	// the connections beyond the limit wait to be accepted.
+	MaxConns uint32 `json:"maxConns"`
+	// CORS handles the CORS requests of the server.
+	CORS *CORS `json:"cors"`
+	// LogLevel is the minimum level of the messages logged by the server: "debug"(default),
+	// "info", "warn", "error" or "fatal". The access logs are not filtered.
+	LogLevel string `json:"logLevel"`
+	// Handler is the APIHandler of the server, default is the `rex.Default()`.
+	Handler *APIHandler `json:"-"`
+	// VirtualHosts maps the hosts to the APIHandlers, like "api.example.com" or
+	// "*.example.com", the Handler serves the unmatched hosts.
+	VirtualHosts map[string]*APIHandler `json:"-"`
+	// Listeners declares more listeners with their own ports, handlers and TLS settings.
+	Listeners []ServerConfig `json:"listeners"`
+
+	// the config file loaded by the LoadConfig
+	filename string
+	loaded   bool
+}
+
+// HTTP2Config contains the HTTP/2 settings.
+type HTTP2Config struct {
+	// MaxConcurrentStreams is the number of concurrent streams per connection, default is 250.
+	MaxConcurrentStreams uint32 `json:"maxConcurrentStreams"`
+	// MaxReadFrameSize is the largest frame size (16KB - 16MB) to read, default is 1MB.
+	MaxReadFrameSize uint32 `json:"maxReadFrameSize"`
+	// IdleTimeout is the timeout in seconds to close the idle connections.
+	IdleTimeout uint32 `json:"idleTimeout"`
 }
 
 // TLSConfig contains options to support https.
@@ -30,6 +89,40 @@ type TLSConfig struct {
 	KeyFile      string        `json:"keyFile"`
 	AutoTLS      AutoTLSConfig `json:"autotls"`
 	AutoRedirect bool          `json:"autoRedirect"`
+	// Listener is a custom listener of the HTTPS server.
+	Listener net.Listener `json:"-"`
+	// Certificates lists more cert/key pairs, the certificate is selected by SNI.
+	Certificates []CertKeyPair `json:"certificates"`
+	// WatchInterval is the interval in seconds to check the cert files for changes,
+	// default is 60. The certificates are reloaded on SIGHUP as well.
+	WatchInterval uint32 `json:"watchInterval"`
+	// MinVersion is the minimum TLS version, like "1.2".
+	MinVersion string `json:"minVersion"`
+	// CipherSuites lists the enabled cipher suites (TLS 1.0-1.2) by the names,
+	// like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	CipherSuites []string `json:"cipherSuites"`
+	// ClientCA is the PEM file of the CAs to verify the client certificates.
+	ClientCA string `json:"clientCA"`
+	// ClientAuth is the client authentication mode: "request", "require",
+	// "verify-if-given" or "require-and-verify", default is "require-and-verify"
+	// if the ClientCA is set.
+	ClientAuth string `json:"clientAuth"`
+	// HSTS contains options of the `Strict-Transport-Security` header.
+	HSTS HSTSConfig `json:"hsts"`
+}
+
+// HSTSConfig contains options of the `Strict-Transport-Security` header that is
+// sent by the HTTPS server, the header is disabled if the MaxAge is zero.
+type HSTSConfig struct {
+	MaxAge            uint32 `json:"maxAge"` // in seconds
+	IncludeSubDomains bool   `json:"includeSubDomains"`
+	Preload           bool   `json:"preload"`
+}
+
+// CertKeyPair contains the cert file and the key file.
+type CertKeyPair struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 // AutoTLSConfig contains options to support autocert by Let's Encrypto SSL.
@@ -42,13 +135,13 @@ type AutoTLSConfig struct {
 
 // CORS contains options to CORS.
 type CORS struct {
-	AllowAllOrigins  bool
-	AllowOrigins     []string
-	AllowMethods     []string
-	AllowHeaders     []string
-	ExposeHeaders    []string
-	AllowCredentials bool
-	MaxAge           int // in seconds
+	AllowAllOrigins  bool     `json:"allowAllOrigins"`
+	AllowOrigins     []string `json:"allowOrigins"`
+	AllowMethods     []string `json:"allowMethods"`
+	AllowHeaders     []string `json:"allowHeaders"`
+	ExposeHeaders    []string `json:"exposeHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	MaxAge           int      `json:"maxAge"` // in seconds
 }
 
 // A ACLUser interface contains the Permissions method that returns the permission IDs
@@ -65,8 +158,47 @@ type Logger interface {
 type Error struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	// Code is a machine-readable error code, like "invalid_email".
+	Code string `json:"code,omitempty"`
+	// Details contains the field-level error messages.
+	Details map[string]string `json:"details,omitempty"`
+	// Cause is the wrapped error, it's not sent to the client.
+	Cause error `json:"-"`
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Cause != nil && e.Cause.Error() != e.Message {
+		if e.Message == "" {
+			return e.Cause.Error()
+		}
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// WithCode sets the machine-readable error code.
+func (e *Error) WithCode(code string) *Error {
+	e.Code = code
+	return e
+}
+
+// WithDetail adds a field-level error message.
+func (e *Error) WithDetail(field string, message string) *Error {
+	if e.Details == nil {
+		e.Details = map[string]string{}
+	}
+	e.Details[field] = message
+	return e
 }
 
+// Err returns an Error with the status and the message, the message is the
+// status text if it's not provided.
 func Err(status int, v ...string) *Error {
 	var messsage string
 	if len(v) > 0 {
@@ -84,6 +216,21 @@ func Err(status int, v ...string) *Error {
 	}
 }
 
+// Wrap returns an Error that wraps the err, the message is the err message if it's
+// not provided, which is not sent to the client for 5xx unless the debug mode is on.
+func Wrap(status int, err error, v ...string) *Error {
+	e := Err(status, v...)
+	if len(v) == 0 && err != nil {
+		e.Message = err.Error()
+	}
+	e.Cause = err
+	return e
+}
+
+func internalError(err error) *Error {
+	return Wrap(500, err)
+}
+
 type recoverError struct {
 	status  int
 	message string
@@ -142,14 +289,15 @@ func HTML(html string, data interface{}) *contentful {
 }
 
 type contentful struct {
-	name    string
-	mtime   time.Time
-	content io.ReadSeeker
+	name     string
+	mtime    time.Time
+	content  io.ReadSeeker
+	encoding string // the content is pre-encoded, like "br" or "gzip"
 }
 
 // Content replies to the request using the content in the provided ReadSeeker.
 func Content(name string, mtime time.Time, r io.ReadSeeker) *contentful {
-	return &contentful{name, mtime, r}
+	return &contentful{name: name, mtime: mtime, content: r}
 }
 
 // File replies to the request using the file content.
@@ -170,22 +318,37 @@ func File(name string) *contentful {
 		panic(&recoverError{500, err.Error()})
 	}
 
-	return &contentful{path.Base(name), fi.ModTime(), file}
+	return &contentful{name: path.Base(name), mtime: fi.ModTime(), content: file}
 }
 
-type fs struct {
-	root     string
-	fallback string
-}
+// FileFS replies to the request using the file content in the provided file system.
+func FileFS(fsys iofs.FS, name string) *contentful {
+	fi, err := iofs.Stat(fsys, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			panic(&recoverError{404, "file not found"})
+		}
+		panic(&recoverError{500, err.Error()})
+	}
+	if fi.IsDir() {
+		panic(&recoverError{400, "is a directory"})
+	}
 
-// FS replies to the request with the contents of the file system rooted at root.
-func FS(root string, fallback string) interface{} {
-	fi, err := os.Lstat(root)
+	file, err := fsys.Open(name)
 	if err != nil {
 		panic(&recoverError{500, err.Error()})
 	}
-	if !fi.IsDir() {
-		panic(&recoverError{500, "FS root is not a directory"})
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		// http.ServeContent requires a seeker, read small non-seekable files into memory
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			panic(&recoverError{500, err.Error()})
+		}
+		content = bytes.NewReader(data)
 	}
-	return &fs{root, fallback}
+
+	return &contentful{name: path.Base(name), mtime: fi.ModTime(), content: content}
 }
@@ -0,0 +1,61 @@
+package rex
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A vhosts dispatches the requests by the host, the pattern is either an exact
+// host like "api.example.com" or a wildcard like "*.example.com" that matches all
+// the subdomains(not the "example.com" itself). The exact hosts win, then the
+// longest wildcard.
+type vhosts struct {
+	exact     map[string]*APIHandler
+	wildcards []wildcardHost
+}
+
+type wildcardHost struct {
+	suffix  string // like ".example.com"
+	handler *APIHandler
+}
+
+func newVHosts(hosts map[string]*APIHandler) (*vhosts, error) {
+	v := &vhosts{exact: map[string]*APIHandler{}}
+	for pattern, handler := range hosts {
+		if handler == nil {
+			return nil, fmt.Errorf("virtual host '%s': missing the handler", pattern)
+		}
+		host := normalizeHost(pattern)
+		if strings.HasPrefix(host, "*.") && len(host) > 2 {
+			v.wildcards = append(v.wildcards, wildcardHost{host[1:], handler})
+		} else if host != "" && !strings.Contains(host, "*") {
+			v.exact[host] = handler
+		} else {
+			return nil, fmt.Errorf("invalid virtual host '%s'", pattern)
+		}
+	}
+	sort.Slice(v.wildcards, func(i, j int) bool {
+		return len(v.wildcards[i].suffix) > len(v.wildcards[j].suffix)
+	})
+	return v, nil
+}
+
+// match returns the handler of the host, or nil if no one matches.
+func (v *vhosts) match(host string) *APIHandler {
+	host = normalizeHost(hostOf(host))
+	if handler, ok := v.exact[host]; ok {
+		return handler
+	}
+	for _, w := range v.wildcards {
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.handler
+		}
+	}
+	return nil
+}
+
+// normalizeHost returns the lower-case host without the trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
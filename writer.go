@@ -13,6 +13,8 @@ type responseWriter struct {
 	status      int
 	written     int
 	compression io.WriteCloser
+	encoding    string
+	level       int
 	rawWriter   http.ResponseWriter
 	headerSent  bool
 }
@@ -27,6 +29,34 @@ func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return nil, nil, fmt.Errorf("the raw response writer does not implement the http.Hijacker")
 }
 
+// Flush sends any buffered data to the client, the compressed data is flushed first.
+func (w *responseWriter) Flush() {
+	if !w.headerSent {
+		w.headerSent = true
+	}
+	if f, ok := w.compression.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.rawWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Push initiates an HTTP/2 server push.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.rawWriter.(http.Pusher)
+	if ok {
+		return p.Push(target, opts)
+	}
+
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the raw response writer, it's used by the http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.rawWriter
+}
+
 // Header returns the header map that will be sent by WriteHeader.
 func (w *responseWriter) Header() http.Header {
 	return w.rawWriter.Header()
@@ -57,9 +87,31 @@ func (w *responseWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom reads data from r until EOF and writes it to the connection, the raw
+// response writer may use sendfile if the compression is disabled.
+func (w *responseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if !w.headerSent {
+		w.headerSent = true
+	}
+	if w.compression != nil {
+		n, err = io.Copy(w.compression, r)
+	} else if rf, ok := w.rawWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.rawWriter, r)
+	}
+	if n > 0 {
+		w.written += int(n)
+	}
+	return
+}
+
 func (w *responseWriter) Close() error {
 	if w.compression != nil {
-		return w.compression.Close()
+		err := w.compression.Close()
+		releaseCompressor(w.compression, w.encoding, w.level)
+		w.compression = nil
+		return err
 	}
 	return nil
 }